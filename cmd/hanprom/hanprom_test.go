@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"testing"
 )
@@ -67,3 +68,26 @@ func TestFramerParser(t *testing.T) {
 		t.Log(d, val)
 	}
 }
+
+func TestMQTTQueue(t *testing.T) {
+	c, err := getClient(&CLI{MQTTBroker: "tcp://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := &Frame{Ident: "test"}
+	val := &Value{Value: 1.5, Unit: "kW"}
+
+	// Published before the broker is reachable, kept for when it is.
+	c.Publish(frame, val)
+	if err := c.Serve(context.Background()); err == nil {
+		t.Fatal("connected to nothing")
+	}
+	select {
+	case msg := <-c.queue.Channel():
+		if msg.frame != frame || msg.val != val {
+			t.Errorf("got %+v", msg)
+		}
+	default:
+		t.Fatal("value dropped")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
@@ -29,11 +32,47 @@ type CLI struct {
 	Addr   string `default:"localhost:2113" help:"HAN address"`
 	Listen string `default:"0.0.0.0:2115" help:"HTTP listener address"`
 
+	TLS           bool   `name:"tls" help:"Use TLS for the HAN connection"`
+	TLSCA         string `name:"tls-ca" help:"CA certificate to verify the HAN server with (default system roots)" type:"existingfile"`
+	TLSCert       string `name:"tls-cert" help:"Client certificate for the HAN connection" type:"existingfile"`
+	TLSKey        string `name:"tls-key" help:"Client certificate key for the HAN connection" type:"existingfile"`
+	TLSServerName string `name:"tls-server-name" help:"Expected HAN server name (default from address)"`
+
 	MQTTBroker   string `help:"MQTT broker address" env:"MQTT_BROKER"`
 	MQTTUsername string `help:"MQTT username" default:"" env:"MQTT_USERNAME"`
 	MQTTPassword string `help:"MQTT password" default:"" env:"MQTT_PASSWORD"`
 }
 
+func dialHAN(cli *CLI) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Minute}
+	if !cli.TLS {
+		return dialer.Dial("tcp", cli.Addr)
+	}
+
+	cfg := &tls.Config{
+		ServerName: cli.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cli.TLSCA != "" {
+		bs, err := os.ReadFile(cli.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("%s: no certificates found", cli.TLSCA)
+		}
+	}
+	if cli.TLSCert != "" || cli.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cli.TLSCert, cli.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return tls.DialWithDialer(dialer, "tcp", cli.Addr, cfg)
+}
+
 func main() {
 	var cli CLI
 	kong.Parse(&cli)
@@ -50,7 +89,7 @@ func main() {
 	}()
 
 	slog.Info("Dialing HAN", "address", cli.Addr)
-	conn, err := net.DialTimeout("tcp", cli.Addr, time.Minute)
+	conn, err := dialHAN(&cli)
 	if err != nil {
 		slog.Error("Failed to connect", "address", cli.Addr, "error", err)
 		os.Exit(1)
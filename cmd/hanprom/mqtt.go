@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"calmh.dev/hassmqtt"
+	"calmh.dev/homeprom/internal/fanout"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -21,7 +22,8 @@ var unitToClass = map[string]string{
 type mqttClient struct {
 	opts        *mqtt.ClientOptions
 	mqttMetrics map[string]*hassmqtt.Metric
-	outbox      chan message
+	outbox      *fanout.Fanout[message]
+	queue       *fanout.Subscription[message] // kept across reconnects
 }
 
 type message struct {
@@ -41,10 +43,14 @@ func getClient(cli *CLI) (*mqttClient, error) {
 	opts.SetConnectTimeout(5 * time.Second)
 	opts.SetWriteTimeout(5 * time.Second)
 
+	// Values published while we're behind are stale by the time we get
+	// to them, so drop the oldest ones first.
+	outbox := fanout.New[message]()
 	return &mqttClient{
 		opts:        opts,
 		mqttMetrics: make(map[string]*hassmqtt.Metric),
-		outbox:      make(chan message, 100),
+		outbox:      outbox,
+		queue:       outbox.Listen(fanout.Options{Buffer: 100, Policy: fanout.DropOldest}),
 	}, nil
 }
 
@@ -59,20 +65,24 @@ func (c *mqttClient) Serve(ctx context.Context) error {
 	}
 	defer client.Disconnect(250)
 
-	for msg := range c.outbox {
-		if err := c.publish(client, msg.frame, msg.val); err != nil {
-			slog.Error("Failed to publish to MQTT", "broker", c.opts.Servers[0], "client_id", c.opts.ClientID, "error", err)
-			return fmt.Errorf("failed to publish: %s", err) // intentionally not wrapped
+	for {
+		select {
+		case msg, ok := <-c.queue.Channel():
+			if !ok {
+				return nil
+			}
+			if err := c.publish(client, msg.frame, msg.val); err != nil {
+				slog.Error("Failed to publish to MQTT", "broker", c.opts.Servers[0], "client_id", c.opts.ClientID, "error", err)
+				return fmt.Errorf("failed to publish: %s", err) // intentionally not wrapped
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-	return nil
 }
 
 func (c *mqttClient) Publish(frame *Frame, val *Value) {
-	select {
-	case c.outbox <- message{frame, val}:
-	default:
-	}
+	_ = c.outbox.Publish(message{frame, val})
 }
 
 func (c *mqttClient) publish(client mqtt.Client, frame *Frame, val *Value) error {
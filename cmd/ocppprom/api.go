@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultSessionLimit = 50
+	defaultHistoryLimit = 1000
+)
+
+// newHTTPMux returns the handler for the HTTP listener: metrics, firmware
+// and diagnostics transfers for the chargers, and the API behind the token
+// if one is set. Changing the tag list and remote control require the
+// token.
+func newHTTPMux(apiToken string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	// The chargers can't authenticate these; uploads need a token from a
+	// diagnostics request instead.
+	mux.HandleFunc("GET /firmware/{name}", handleFirmwareFile)
+	mux.HandleFunc("PUT /upload/{token}/{name...}", handleUpload)
+	mux.HandleFunc("POST /upload/{token}/{name...}", handleUpload)
+	api := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, requireToken(apiToken, h))
+	}
+	api("GET /sessions", handleSessions)
+	api("GET /meters/history", handleMeterHistory)
+	api("GET /tags", handleListTags)
+	api("GET /firmware", handleListFirmware)
+	api("GET /maintenance", handleMaintenanceStatus)
+	if apiToken != "" {
+		// Deciding who may charge and controlling the chargers is too
+		// much to allow without.
+		api("PUT /tags/{id}", handlePutTag)
+		api("DELETE /tags/{id}", handleDeleteTag)
+		addRemoteControl(api)
+	} else {
+		slog.Info("Tag changes and remote control disabled without an API token")
+	}
+	return mux
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type sessionResponse struct {
+	transaction
+	EnergyWh int `json:"energyWh"`
+}
+
+// handleSessions lists recent charging sessions, newest first. The
+// optional query parameters are "chargepoint" to filter on and "limit".
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	limit := defaultSessionLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ts, err := transactions.Recent(limit, r.URL.Query().Get("chargepoint"))
+	if err != nil {
+		slog.Error("Failed to list transactions", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	res := make([]sessionResponse, len(ts))
+	for i, t := range ts {
+		res[i] = sessionResponse{transaction: t, EnergyWh: t.EnergyWh()}
+	}
+	writeJSON(w, res)
+}
+
+// handleMeterHistory lists the meter readings a charge point sent late,
+// after being offline. The query parameters are "chargepoint", and
+// optionally "from" and "to" as RFC 3339 times and "limit".
+func handleMeterHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	chargePoint := q.Get("chargepoint")
+	if chargePoint == "" {
+		http.Error(w, "missing chargepoint", http.StatusBadRequest)
+		return
+	}
+	from, to := time.Unix(0, 0), time.Now()
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if s := q.Get(p.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, "bad "+p.name, http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+	limit := defaultHistoryLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	res, err := meters.History(chargePoint, from, to, limit)
+	if err != nil {
+		slog.Error("Failed to read meter history", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func handleListTags(w http.ResponseWriter, r *http.Request) {
+	ts, err := tags.List()
+	if err != nil {
+		slog.Error("Failed to list tags", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, ts)
+}
+
+// handlePutTag adds or replaces the tag named in the path with the one in
+// the body, and pushes the new list to the chargers.
+func handlePutTag(w http.ResponseWriter, r *http.Request) {
+	var t idTag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.IDTag = r.PathValue("id")
+	if err := t.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tags.Put(t); err != nil {
+		slog.Error("Failed to store tag", "idTag", t.IDTag, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Stored tag", "idTag", t.IDTag, "status", t.Status)
+	go pushLocalList()
+	writeJSON(w, t)
+}
+
+func handleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := tags.Delete(id); errors.Is(err, errUnknownTag) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to delete tag", "idTag", id, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Deleted tag", "idTag", id)
+	go pushLocalList()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
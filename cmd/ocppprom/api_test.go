@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestAPIToken(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	t.Cleanup(restore(&tags))
+	tags = newTagStore(db)
+
+	srv := httptest.NewServer(newHTTPMux("secret"))
+	defer srv.Close()
+
+	put := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/tags/abc123", strings.NewReader(`{"status":"Accepted"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Errorf("no token: status %d", code)
+	}
+	if code := put("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", code)
+	}
+	if code := put("secret"); code != http.StatusOK {
+		t.Errorf("right token: status %d", code)
+	}
+	if _, err := tags.Get("abc123"); err != nil {
+		t.Errorf("tag not stored: %v", err)
+	}
+}
+
+func TestRemoteControlRequiresToken(t *testing.T) {
+	for token, want := range map[string]int{"": http.StatusNotFound, "secret": http.StatusNotFound} {
+		srv := httptest.NewServer(newHTTPMux(token))
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/chargepoints/cp1/reset", strings.NewReader(`{"type":"Soft"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: status %d, expected %d", token, resp.StatusCode, want)
+		}
+		// Without a token the route doesn't exist; with one, the charge
+		// point isn't connected.
+		if connected := strings.Contains(string(body), "not connected"); connected != (token != "") {
+			t.Errorf("token %q: unexpected response %q", token, body)
+		}
+	}
+}
+
+func TestTagChangesRequireToken(t *testing.T) {
+	setupCSMS(t)
+	srv := httptest.NewServer(newHTTPMux(""))
+	defer srv.Close()
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, _ := http.NewRequest(method, srv.URL+"/tags/abc123", strings.NewReader(`{"status":"Accepted"}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s without a token: status %d", method, resp.StatusCode)
+		}
+	}
+	if _, err := tags.Get("abc123"); err == nil {
+		t.Error("tag stored without a token")
+	}
+}
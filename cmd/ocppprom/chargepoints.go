@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	chargerConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_connected",
+	}, []string{"chargepoint"})
+	chargerConnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_connects_total",
+	}, []string{"chargepoint"})
+	chargerDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_disconnects_total",
+	}, []string{"chargepoint"})
+)
+
+// chargePoints keeps track of the connected charge points, for the things
+// we initiate rather than do in response to them.
+var chargePoints = &registry{cps: make(map[string]*chargePoint)}
+
+type registry struct {
+	mut sync.Mutex
+	cps map[string]*chargePoint
+}
+
+// add records cp as the current connection for its ID.
+func (r *registry) add(cp *chargePoint) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.cps[cp.ID] = cp
+	chargerConnects.WithLabelValues(cp.ID).Inc()
+	chargerConnected.WithLabelValues(cp.ID).Set(1)
+}
+
+// remove forgets cp, unless it has already been replaced by a newer
+// connection.
+func (r *registry) remove(cp *chargePoint) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	chargerDisconnects.WithLabelValues(cp.ID).Inc()
+	if r.cps[cp.ID] == cp {
+		delete(r.cps, cp.ID)
+		chargerConnected.WithLabelValues(cp.ID).Set(0)
+	}
+}
+
+// Get returns the charge point with the given ID, if it's connected.
+func (r *registry) Get(id string) (*chargePoint, bool) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	cp, ok := r.cps[id]
+	if !ok || !cp.Connected() {
+		return nil, false
+	}
+	return cp, true
+}
+
+// Connected returns the connected charge points speaking the protocol, or
+// all of them if it's empty, ordered by ID.
+func (r *registry) Connected(proto string) []*chargePoint {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var cps []*chargePoint
+	for _, cp := range r.cps {
+		if cp.Connected() && (proto == "" || cp.proto == proto) {
+			cps = append(cps, cp)
+		}
+	}
+	slices.SortFunc(cps, func(a, b *chargePoint) int { return strings.Compare(a.ID, b.ID) })
+	return cps
+}
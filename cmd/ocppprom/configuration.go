@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var chargerConfigInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "charger_config_info",
+}, []string{"chargepoint", "key", "value", "readonly"})
+
+// configProfile sets configuration keys on the chargers it matches. Empty
+// match fields match any charger.
+type configProfile struct {
+	ChargePoint string            `json:"chargePoint,omitempty"`
+	Vendor      string            `json:"vendor,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	Config      map[string]string `json:"config"`
+}
+
+func (p *configProfile) matches(chargePoint, vendor, model string) bool {
+	return (p.ChargePoint == "" || p.ChargePoint == chargePoint) &&
+		(p.Vendor == "" || p.Vendor == vendor) &&
+		(p.Model == "" || p.Model == model)
+}
+
+// chargerConfig is what we want the chargers' configuration to be: the
+// defaults from the command line, overridden by the matching profiles in
+// the order they are given.
+type chargerConfig struct {
+	defaults map[string]string
+	Profiles []configProfile `json:"profiles"`
+}
+
+func newChargerConfig(path string, defaults map[string]string) (*chargerConfig, error) {
+	c := &chargerConfig{defaults: defaults}
+	if path == "" {
+		return c, nil
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// For returns the configuration for the charger.
+func (c *chargerConfig) For(chargePoint, vendor, model string) map[string]string {
+	res := make(map[string]string, len(c.defaults))
+	for k, v := range c.defaults {
+		res[k] = v
+	}
+	for _, p := range c.Profiles {
+		if p.matches(chargePoint, vendor, model) {
+			for k, v := range p.Config {
+				res[k] = v
+			}
+		}
+	}
+	return res
+}
+
+type configurationKey struct {
+	Key      string  `json:"key"`
+	Readonly bool    `json:"readonly"`
+	Value    *string `json:"value,omitempty"`
+}
+
+// The library's GetConfigurationConf has the keys as a map, which isn't
+// what chargers send.
+type getConfigurationConf struct {
+	ConfigurationKey []configurationKey `json:"configurationKey"`
+	UnknownKey       []string           `json:"unknownKey"`
+}
+
+// Apply reads the charger's configuration, exports it, and changes the
+// keys it supports that differ from what we want, as far as we may. Only
+// the values of the keys we manage are exported, as the others may hold
+// secrets.
+func (c *chargerConfig) Apply(cp *chargePoint, vendor, model string) {
+	want := c.For(cp.ID, vendor, model)
+
+	var current map[string]configurationKey
+	var conf getConfigurationConf
+	err := cp.Call("GetConfiguration", v16.GetConfigurationReq{}, &conf)
+	switch {
+	case errors.Is(err, errNotAllowed):
+		// We'll just have to try, if we may.
+	case err != nil:
+		// We'll just have to try.
+		slog.Error("Failed to get configuration", "id", cp.ID, "err", err)
+	default:
+		current = make(map[string]configurationKey, len(conf.ConfigurationKey))
+		chargerConfigInfo.DeletePartialMatch(prometheus.Labels{"chargepoint": cp.ID})
+		for _, k := range conf.ConfigurationKey {
+			current[k.Key] = k
+			if _, ok := want[k.Key]; !ok {
+				k.Value = nil
+			}
+			setConfigInfo(cp.ID, k)
+		}
+	}
+
+	if !cp.mayCall("ChangeConfiguration") {
+		return
+	}
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		val := want[key]
+		if current != nil {
+			cur, ok := current[key]
+			switch {
+			case !ok:
+				slog.Debug("Configuration key not supported", "id", cp.ID, "key", key)
+				continue
+			case cur.Value != nil && sameConfigValue(*cur.Value, val):
+				continue
+			case cur.Readonly:
+				slog.Warn("Configuration key is read only", "id", cp.ID, "key", key, "val", ptrs(cur.Value), "wanted", val)
+				continue
+			}
+		}
+
+		var res v16.ChangeConfigurationConf
+		if err := cp.Call("ChangeConfiguration", v16.ChangeConfigurationReq{Key: key, Value: val}, &res); err != nil {
+			slog.Error("Failed to change configuration", "id", cp.ID, "key", key, "val", val, "err", err)
+			continue
+		}
+		switch res.Status {
+		case "Accepted":
+			slog.Info("Changed configuration", "id", cp.ID, "key", key, "val", val)
+		case "RebootRequired":
+			slog.Warn("Changed configuration, takes effect after reboot", "id", cp.ID, "key", key, "val", val)
+		default:
+			slog.Error("Failed to change configuration", "id", cp.ID, "key", key, "val", val, "status", res.Status)
+			continue
+		}
+		chargerConfigInfo.DeletePartialMatch(prometheus.Labels{"chargepoint": cp.ID, "key": key})
+		setConfigInfo(cp.ID, configurationKey{Key: key, Value: &val})
+	}
+}
+
+func setConfigInfo(chargePoint string, k configurationKey) {
+	chargerConfigInfo.WithLabelValues(chargePoint, k.Key, ptrs(k.Value), strconv.FormatBool(k.Readonly)).Set(1)
+}
+
+// sameConfigValue compares configuration values, taking lists like
+// measurands to be the same regardless of order and spacing.
+func sameConfigValue(a, b string) bool {
+	as := strings.Split(a, ",")
+	bs := strings.Split(b, ",")
+	for i := range as {
+		as[i] = strings.TrimSpace(as[i])
+	}
+	for i := range bs {
+		bs[i] = strings.TrimSpace(bs[i])
+	}
+	slices.Sort(as)
+	slices.Sort(bs)
+	return slices.Equal(as, bs)
+}
+
+func ptrs(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyConfiguration(t *testing.T) {
+	conn := setupCSMS(t)("cp1", ocppV16)
+	chargerConfigs = &chargerConfig{
+		defaults: map[string]string{
+			"MeterValueSampleInterval": "15",
+			"MeterValuesSampledData":   "Energy.Active.Import.Register,Current.Import",
+			"MinimumStatusDuration":    "30",
+		},
+		Profiles: []configProfile{
+			{Vendor: "Acme", Config: map[string]string{"MeterValueSampleInterval": "60"}},
+			{ChargePoint: "other", Config: map[string]string{"MeterValueSampleInterval": "5"}},
+		},
+	}
+
+	sent := chargerMessagesSent.WithLabelValues("cp1", "ChangeConfiguration", resultOK)
+	before := testutil.ToFloat64(sent)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`[2,"b1","BootNotification",{"chargePointVendor":"Acme","chargePointModel":"X"}]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := map[string]string{}
+	for done := false; !done; {
+		var frame []json.RawMessage
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if string(frame[0]) != "2" {
+			continue
+		}
+		var uid, action string
+		_ = json.Unmarshal(frame[1], &uid)
+		_ = json.Unmarshal(frame[2], &action)
+		var res any
+		switch action {
+		case "GetConfiguration":
+			res = map[string]any{"configurationKey": []map[string]any{
+				{"key": "MeterValueSampleInterval", "readonly": false, "value": "10"},
+				{"key": "MeterValuesSampledData", "readonly": false, "value": "Current.Import, Energy.Active.Import.Register"},
+				{"key": "AuthorizationKey", "readonly": false, "value": "secret"},
+			}}
+		case "ChangeConfiguration":
+			var req struct{ Key, Value string }
+			_ = json.Unmarshal(frame[3], &req)
+			changed[req.Key] = req.Value
+			res = map[string]string{"status": "Accepted"}
+		case "GetLocalListVersion":
+			res = map[string]int{"listVersion": -1}
+		case "TriggerMessage":
+			res = map[string]string{"status": "Accepted"}
+			done = true
+		default:
+			t.Fatalf("unexpected call %s", action)
+		}
+		if err := conn.WriteJSON([]any{3, uid, res}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The sampled data is the same, and MinimumStatusDuration isn't
+	// supported.
+	if len(changed) != 1 || changed["MeterValueSampleInterval"] != "60" {
+		t.Errorf("unexpected changes %v", changed)
+	}
+	if v := testutil.ToFloat64(chargerConfigInfo.WithLabelValues("cp1", "MeterValueSampleInterval", "60", "false")); v != 1 {
+		t.Errorf("changed value not exported")
+	}
+	if v := testutil.ToFloat64(chargerConfigInfo.WithLabelValues("cp1", "AuthorizationKey", "", "false")); v != 1 {
+		t.Errorf("unmanaged value not redacted")
+	}
+	if n := testutil.CollectAndCount(chargerConfigInfo); n != 3 {
+		t.Errorf("expected three exported keys, got %d", n)
+	}
+	if v := testutil.ToFloat64(sent) - before; v != 1 {
+		t.Errorf("sent calls counted %v times", v)
+	}
+}
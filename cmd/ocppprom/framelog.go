@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// The frame log has every OCPP frame to and from the chargers as JSON
+// lines, for looking into charger quirks after the fact and for replaying
+// with internal/ocppsim.
+
+const (
+	frameIn  = "in"  // from the charger
+	frameOut = "out" // to the charger
+)
+
+var frameLog *frameLogger // nil unless logging frames
+
+type loggedFrame struct {
+	Time        time.Time       `json:"time"`
+	ChargePoint string          `json:"chargepoint"`
+	Direction   string          `json:"direction"`
+	Frame       json.RawMessage `json:"frame"`
+}
+
+type frameLogger struct {
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+// openFrameLog appends to the log at path. The frames have idTags in them,
+// so the file is for our eyes only.
+func openFrameLog(path string) (*frameLogger, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return newFrameLogger(fd), nil
+}
+
+func newFrameLogger(w io.Writer) *frameLogger {
+	return &frameLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *frameLogger) Log(chargePoint, direction string, frame []byte) {
+	if !json.Valid(frame) {
+		// Whatever the charger sent, as a string.
+		frame, _ = json.Marshal(string(frame))
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if err := l.enc.Encode(loggedFrame{Time: time.Now().UTC(), ChargePoint: chargePoint, Direction: direction, Frame: frame}); err != nil {
+		slog.Error("Failed to log frame", "id", chargePoint, "err", err)
+	}
+}
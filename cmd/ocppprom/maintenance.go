@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Firmware updates and diagnostics uploads. We host the firmware images
+// and take the diagnostics uploads on the HTTP listener, so the chargers
+// don't need the vendor's cloud for either, and track what the chargers
+// say about how it's going.
+
+const (
+	maintenancePrefix = "maintenance\x00"
+	// How long a charger has to upload diagnostics after we ask for them.
+	uploadTimeout = time.Hour
+)
+
+var maxUploadSize int64 = 256 << 20 // lowered in tests
+
+var (
+	chargerFirmwareStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_firmware_status",
+	}, []string{"chargepoint", "status"})
+	chargerDiagnosticsStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_diagnostics_status",
+	}, []string{"chargepoint", "status"})
+	chargerDiagnosticsUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_diagnostics_uploads_total",
+	}, []string{"chargepoint"})
+)
+
+var (
+	errNoFirmware    = errors.New("no such firmware image")
+	errBadUpload     = errors.New("unknown or expired upload")
+	errNotConfigured = errors.New("public URL and directory not configured")
+)
+
+// maintenanceState is the latest we know about a charger's firmware update
+// and diagnostics upload.
+type maintenanceState struct {
+	ChargePoint        string     `json:"chargePoint"`
+	FirmwareStatus     string     `json:"firmwareStatus,omitempty"`
+	FirmwareFile       string     `json:"firmwareFile,omitempty"`
+	FirmwareUpdated    *time.Time `json:"firmwareUpdated,omitempty"`
+	DiagnosticsStatus  string     `json:"diagnosticsStatus,omitempty"`
+	DiagnosticsFile    string     `json:"diagnosticsFile,omitempty"`
+	DiagnosticsUpdated *time.Time `json:"diagnosticsUpdated,omitempty"`
+}
+
+type firmwareImage struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type pendingUpload struct {
+	chargePoint string
+	expires     time.Time
+}
+
+// maintenanceStore keeps the maintenance state in the database and the
+// upload tokens we've handed out in memory.
+type maintenanceStore struct {
+	db             *leveldb.DB
+	publicURL      string
+	firmwareDir    string
+	diagnosticsDir string
+
+	mut     sync.Mutex
+	uploads map[string]pendingUpload
+}
+
+func newMaintenanceStore(db *leveldb.DB, publicURL, firmwareDir, diagnosticsDir string) (*maintenanceStore, error) {
+	s := &maintenanceStore{
+		db:             db,
+		publicURL:      strings.TrimSuffix(publicURL, "/"),
+		firmwareDir:    firmwareDir,
+		diagnosticsDir: diagnosticsDir,
+		uploads:        make(map[string]pendingUpload),
+	}
+	states, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range states {
+		setStatus(chargerFirmwareStatus, st.ChargePoint, st.FirmwareStatus)
+		setStatus(chargerDiagnosticsStatus, st.ChargePoint, st.DiagnosticsStatus)
+	}
+	return s, nil
+}
+
+// setStatus sets the charger's status in the state set metric.
+func setStatus(vec *prometheus.GaugeVec, chargePoint, status string) {
+	if status == "" {
+		return
+	}
+	vec.DeletePartialMatch(prometheus.Labels{"chargepoint": chargePoint})
+	vec.WithLabelValues(chargePoint, status).Set(1)
+}
+
+func (s *maintenanceStore) List() ([]maintenanceState, error) {
+	it := s.db.NewIterator(util.BytesPrefix([]byte(maintenancePrefix)), nil)
+	defer it.Release()
+	states := []maintenanceState{}
+	for it.Next() {
+		var st maintenanceState
+		if err := json.Unmarshal(it.Value(), &st); err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, it.Error()
+}
+
+// update changes the charger's stored state with fn.
+func (s *maintenanceStore) update(chargePoint string, fn func(st *maintenanceState)) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	key := []byte(maintenancePrefix + chargePoint)
+	st := maintenanceState{ChargePoint: chargePoint}
+	bs, err := s.db.Get(key, nil)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(bs, &st); err != nil {
+			return err
+		}
+	case !errors.Is(err, leveldb.ErrNotFound):
+		return err
+	}
+	fn(&st)
+	bs, err = json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(key, bs, nil)
+}
+
+// FirmwareStatus records the charger's firmware update status, and the
+// image when we asked for the update.
+func (s *maintenanceStore) FirmwareStatus(chargePoint, status, file string) {
+	now := time.Now()
+	err := s.update(chargePoint, func(st *maintenanceState) {
+		st.FirmwareStatus = status
+		st.FirmwareUpdated = &now
+		if file != "" {
+			st.FirmwareFile = file
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to store firmware status", "id", chargePoint, "err", err)
+	}
+	setStatus(chargerFirmwareStatus, chargePoint, status)
+}
+
+// DiagnosticsStatus records the charger's diagnostics upload status, and
+// the file when we've got one.
+func (s *maintenanceStore) DiagnosticsStatus(chargePoint, status, file string) {
+	now := time.Now()
+	err := s.update(chargePoint, func(st *maintenanceState) {
+		st.DiagnosticsStatus = status
+		st.DiagnosticsUpdated = &now
+		if file != "" {
+			st.DiagnosticsFile = file
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to store diagnostics status", "id", chargePoint, "err", err)
+	}
+	setStatus(chargerDiagnosticsStatus, chargePoint, status)
+}
+
+// Firmware lists the firmware images we host.
+func (s *maintenanceStore) Firmware() ([]firmwareImage, error) {
+	images := []firmwareImage{}
+	if s.firmwareDir == "" {
+		return images, nil
+	}
+	entries, err := os.ReadDir(s.firmwareDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !validFileName(e.Name()) || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, firmwareImage{Name: e.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	return images, nil
+}
+
+// firmwarePath returns the path of the named image, if we have it.
+func (s *maintenanceStore) firmwarePath(name string) (string, error) {
+	if s.firmwareDir == "" || !validFileName(name) {
+		return "", errNoFirmware
+	}
+	path := filepath.Join(s.firmwareDir, name)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", errNoFirmware
+	}
+	return path, nil
+}
+
+// FirmwareLocation returns the URL the chargers download the named image
+// from.
+func (s *maintenanceStore) FirmwareLocation(name string) (string, error) {
+	if s.publicURL == "" || s.firmwareDir == "" {
+		return "", errNotConfigured
+	}
+	if _, err := s.firmwarePath(name); err != nil {
+		return "", err
+	}
+	return s.publicURL + "/firmware/" + url.PathEscape(name), nil
+}
+
+// NewUpload returns the URL where the charger may upload diagnostics for a
+// while.
+func (s *maintenanceStore) NewUpload(chargePoint string) (string, error) {
+	if s.publicURL == "" || s.diagnosticsDir == "" {
+		return "", errNotConfigured
+	}
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(bs)
+
+	now := time.Now()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for t, u := range s.uploads {
+		if now.After(u.expires) {
+			delete(s.uploads, t)
+		}
+	}
+	s.uploads[token] = pendingUpload{chargePoint: chargePoint, expires: now.Add(uploadTimeout)}
+	return s.publicURL + "/upload/" + token + "/", nil
+}
+
+// Receive stores an upload for the token, as the charger's ID and the time
+// followed by the name it gave the file, and returns the file name. The
+// token is used up once the file is stored.
+func (s *maintenanceStore) Receive(token, name string, r io.Reader) (string, error) {
+	s.mut.Lock()
+	u, ok := s.uploads[token]
+	s.mut.Unlock()
+	if !ok || time.Now().After(u.expires) {
+		return "", errBadUpload
+	}
+
+	name = filepath.Base(name)
+	if !validFileName(name) {
+		name = "diagnostics"
+	}
+	name = u.chargePoint + "-" + time.Now().UTC().Format("20060102T150405Z") + "-" + name
+
+	fd, err := os.CreateTemp(s.diagnosticsDir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(fd.Name())
+	if _, err := io.Copy(fd, r); err != nil {
+		fd.Close()
+		return "", err
+	}
+	if err := fd.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(fd.Name(), filepath.Join(s.diagnosticsDir, name)); err != nil {
+		return "", err
+	}
+
+	s.mut.Lock()
+	delete(s.uploads, token)
+	s.mut.Unlock()
+
+	chargerDiagnosticsUploads.WithLabelValues(u.chargePoint).Inc()
+	if err := s.update(u.chargePoint, func(st *maintenanceState) { st.DiagnosticsFile = name }); err != nil {
+		slog.Error("Failed to store diagnostics file", "id", u.chargePoint, "err", err)
+	}
+	return name, nil
+}
+
+// validFileName returns whether name is a plain file name we're happy to
+// serve or store.
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+func diagnosticsStatusNotification(cp *chargePoint, p *v16.DiagnosticsStatusNotificationReq) *v16.DiagnosticsStatusNotificationConf {
+	slog.Info("Diagnostics status", "id", cp.ID, "status", p.Status)
+	maintenance.DiagnosticsStatus(cp.ID, p.Status, "")
+	return &v16.DiagnosticsStatusNotificationConf{}
+}
+
+// firmwareStatusNotificationReq stands in for the library's, whose
+// validation takes the security extension's statuses and so refuses
+// Installing and Installed.
+type firmwareStatusNotificationReq struct {
+	Status string `json:"status"`
+}
+
+func firmwareStatusNotification(cp *chargePoint, p *firmwareStatusNotificationReq) *v16.FirmwareStatusNotificationConf {
+	slog.Info("Firmware status", "id", cp.ID, "status", p.Status)
+	maintenance.FirmwareStatus(cp.ID, p.Status, "")
+	return &v16.FirmwareStatusNotificationConf{}
+}
+
+type firmwareStatusNotificationReq201 struct {
+	Status    string `json:"status"`
+	RequestID *int   `json:"requestId,omitempty"`
+}
+
+func firmwareStatusNotification201(cp *chargePoint, p *firmwareStatusNotificationReq201) *struct{} {
+	slog.Info("Firmware status", "id", cp.ID, "status", p.Status)
+	maintenance.FirmwareStatus(cp.ID, p.Status, "")
+	return &struct{}{}
+}
+
+func handleFirmwareFile(w http.ResponseWriter, r *http.Request) {
+	path, err := maintenance.firmwarePath(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	slog.Info("Serving firmware", "file", r.PathValue("name"), "remote", r.RemoteAddr)
+	http.ServeFile(w, r, path)
+}
+
+// handleUpload takes a diagnostics upload, either as the body of a PUT or
+// POST or as a file in a multipart form.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	name := r.PathValue("name")
+	var body io.Reader = r.Body
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				http.Error(w, "no file in form", http.StatusBadRequest)
+				return
+			}
+			if part.FileName() != "" {
+				if name == "" {
+					name = part.FileName()
+				}
+				body = part
+				break
+			}
+		}
+	}
+
+	file, err := maintenance.Receive(r.PathValue("token"), name, body)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errBadUpload) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.As(err, &tooLarge) {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		slog.Error("Failed to receive diagnostics", "err", err)
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Received diagnostics", "file", file)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleListFirmware(w http.ResponseWriter, r *http.Request) {
+	images, err := maintenance.Firmware()
+	if err != nil {
+		slog.Error("Failed to list firmware", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, images)
+}
+
+func handleMaintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	states, err := maintenance.List()
+	if err != nil {
+		slog.Error("Failed to list maintenance state", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, states)
+}
+
+type updateFirmwareRequest struct {
+	File          string     `json:"file"`
+	RetrieveDate  *time.Time `json:"retrieveDate,omitempty"`
+	Retries       int        `json:"retries,omitempty"`
+	RetryInterval int        `json:"retryInterval,omitempty"`
+}
+
+// handleUpdateFirmware asks the charge point in the path to update to one
+// of our firmware images, now unless another retrieve date is given.
+func handleUpdateFirmware(w http.ResponseWriter, r *http.Request) {
+	var req updateFirmwareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, err := maintenance.FirmwareLocation(req.File)
+	switch {
+	case errors.Is(err, errNoFirmware):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	cp, ok := connectedV16(w, r)
+	if !ok {
+		return
+	}
+
+	retrieve := time.Now()
+	if req.RetrieveDate != nil {
+		retrieve = *req.RetrieveDate
+	}
+	call := v16.UpdateFirmwareReq{
+		Location:      location,
+		Retries:       req.Retries,
+		RetrieveDate:  retrieve.UTC().Format(time.RFC3339),
+		RetryInterval: req.RetryInterval,
+	}
+	slog.Info("Remote call", "id", cp.ID, "action", "UpdateFirmware", "req", call)
+	if err := cp.Call("UpdateFirmware", call, nil); err != nil {
+		slog.Error("Remote call failed", "id", cp.ID, "action", "UpdateFirmware", "err", err)
+		writeCallError(w, err)
+		return
+	}
+	maintenance.FirmwareStatus(cp.ID, "Requested", req.File)
+	writeJSON(w, call)
+}
+
+type getDiagnosticsRequest struct {
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	StopTime      *time.Time `json:"stopTime,omitempty"`
+	Retries       int        `json:"retries,omitempty"`
+	RetryInterval int        `json:"retryInterval,omitempty"`
+}
+
+// handleGetDiagnostics asks the charge point in the path to upload its
+// diagnostics to us, and responds with the file name it will use.
+func handleGetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	var req getDiagnosticsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cp, ok := connectedV16(w, r)
+	if !ok {
+		return
+	}
+	location, err := maintenance.NewUpload(cp.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	call := v16.GetDiagnosticsReq{
+		Location:      location,
+		Retries:       req.Retries,
+		RetryInterval: req.RetryInterval,
+		StartTime:     formatTime(req.StartTime),
+		StopTime:      formatTime(req.StopTime),
+	}
+	slog.Info("Remote call", "id", cp.ID, "action", "GetDiagnostics")
+	var conf v16.GetDiagnosticsConf
+	if err := cp.Call("GetDiagnostics", call, &conf); err != nil {
+		slog.Error("Remote call failed", "id", cp.ID, "action", "GetDiagnostics", "err", err)
+		writeCallError(w, err)
+		return
+	}
+	if conf.FileName == "" {
+		// The charger has nothing for the period.
+		maintenance.DiagnosticsStatus(cp.ID, "NoDiagnostics", "")
+	} else {
+		maintenance.DiagnosticsStatus(cp.ID, "Requested", "")
+	}
+	writeJSON(w, conf)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
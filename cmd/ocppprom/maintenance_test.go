@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaintenance(t *testing.T) {
+	conn := setupCSMS(t)("cp1", ocppV16)
+	firmwareDir, diagnosticsDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(firmwareDir, "fw-1.2.bin"), []byte("firmware"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	maintenance, err = newMaintenanceStore(maintenance.db, "http://csms.example", firmwareDir, diagnosticsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHTTPMux(""))
+	defer srv.Close()
+
+	// Firmware is served, but nothing outside the directory.
+	if loc, err := maintenance.FirmwareLocation("fw-1.2.bin"); err != nil || loc != "http://csms.example/firmware/fw-1.2.bin" {
+		t.Errorf("location %q, %v", loc, err)
+	}
+	for path, code := range map[string]int{"/firmware/fw-1.2.bin": 200, "/firmware/.hidden": 404, "/firmware/..%2fx": 404} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("%s: %d, expected %d", path, resp.StatusCode, code)
+		}
+	}
+
+	// Uploads need a token.
+	loc, err := maintenance.NewUpload("cp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(url string) int {
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader("logs"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := upload(srv.URL + "/upload/bogus/diag.zip"); code != http.StatusForbidden {
+		t.Errorf("bad token: %d", code)
+	}
+	if code := upload(srv.URL + strings.TrimPrefix(loc, "http://csms.example") + "diag.zip"); code != http.StatusCreated {
+		t.Errorf("upload: %d", code)
+	}
+	stored, _ := filepath.Glob(filepath.Join(diagnosticsDir, "cp1-*-diag.zip"))
+	if len(stored) != 1 {
+		t.Fatalf("stored %v", stored)
+	}
+	if bs, err := os.ReadFile(stored[0]); err != nil || string(bs) != "logs" {
+		t.Errorf("stored %q, %v", bs, err)
+	}
+	if code := upload(srv.URL + strings.TrimPrefix(loc, "http://csms.example") + "other.zip"); code != http.StatusForbidden {
+		t.Errorf("second upload with the same token: %d", code)
+	}
+
+	// Too large.
+	defer func(size int64) { maxUploadSize = size }(maxUploadSize)
+	maxUploadSize = 3
+	if loc, err = maintenance.NewUpload("cp1"); err != nil {
+		t.Fatal(err)
+	}
+	if code := upload(srv.URL + strings.TrimPrefix(loc, "http://csms.example") + "diag.zip"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large upload: %d", code)
+	}
+
+	// Status notifications are tracked.
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{
+		`[2,"1","FirmwareStatusNotification",{"status":"Downloading"}]`,
+		`[2,"2","FirmwareStatusNotification",{"status":"Installed"}]`,
+		`[2,"3","DiagnosticsStatusNotification",{"status":"Uploaded"}]`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := testutil.ToFloat64(chargerFirmwareStatus.WithLabelValues("cp1", "Installed")); v != 1 {
+		t.Errorf("firmware status not set")
+	}
+	if n := testutil.CollectAndCount(chargerFirmwareStatus); n != 1 {
+		t.Errorf("expected one firmware status, got %d", n)
+	}
+
+	resp, err := http.Get(srv.URL + "/maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, _ := io.ReadAll(resp.Body)
+	for _, s := range []string{`"firmwareStatus": "Installed"`, `"diagnosticsStatus": "Uploaded"`, `"diagnosticsFile": "` + filepath.Base(stored[0]) + `"`} {
+		if !strings.Contains(string(bs), s) {
+			t.Errorf("missing %s in %s", s, bs)
+		}
+	}
+}
+
+func TestMaintenanceCalls(t *testing.T) {
+	conn := setupCSMS(t)("cp1", ocppV16)
+	firmwareDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(firmwareDir, "fw-1.2.bin"), []byte("firmware"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	maintenance, err = newMaintenanceStore(maintenance.db, "http://csms.example", firmwareDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHTTPMux("secret"))
+	defer srv.Close()
+
+	// Once we have answered a call, the charge point is registered.
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`[2,"1","Heartbeat",{}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// post makes the API request, answers the call it causes with res, and
+	// returns the call's payload and the API response.
+	post := func(path, body string, res any) (map[string]any, int, string) {
+		t.Helper()
+		type response struct {
+			code int
+			body string
+		}
+		done := make(chan response, 1)
+		go func() {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				done <- response{body: err.Error()}
+				return
+			}
+			defer resp.Body.Close()
+			bs, _ := io.ReadAll(resp.Body)
+			done <- response{resp.StatusCode, string(bs)}
+		}()
+		var frame []json.RawMessage
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]any
+		_ = json.Unmarshal(frame[3], &payload)
+		if err := conn.WriteJSON([]any{messageCallResult, json.RawMessage(frame[1]), res}); err != nil {
+			t.Fatal(err)
+		}
+		r := <-done
+		return payload, r.code, r.body
+	}
+
+	call, code, _ := post("/chargepoints/cp1/firmware", `{"file":"fw-1.2.bin","retries":3}`, map[string]any{})
+	if code != http.StatusOK || call["location"] != "http://csms.example/firmware/fw-1.2.bin" || call["retries"] != 3.0 {
+		t.Errorf("update firmware: %d, %v", code, call)
+	}
+	if st, _ := maintenance.List(); len(st) != 1 || st[0].FirmwareStatus != "Requested" || st[0].FirmwareFile != "fw-1.2.bin" {
+		t.Errorf("firmware status %+v", st)
+	}
+
+	call, code, body := post("/chargepoints/cp1/diagnostics", ``, map[string]any{"fileName": "diag.zip"})
+	loc, _ := call["location"].(string)
+	if code != http.StatusOK || !strings.HasPrefix(loc, "http://csms.example/upload/") || !strings.Contains(body, `"diag.zip"`) {
+		t.Errorf("get diagnostics: %d, %v, %s", code, call, body)
+	}
+	if st, _ := maintenance.List(); len(st) != 1 || st[0].DiagnosticsStatus != "Requested" {
+		t.Errorf("diagnostics status %+v", st)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// Meter values are stored under this prefix followed by the series
+	// labels, so that they survive a restart.
+	meterPrefix = "meter\x00"
+	// Readings sent late are stored under this prefix followed by the
+	// charge point, the big endian timestamp and the series labels.
+	historyPrefix = "history\x00"
+	// Readings from before the charger connected and older than this when
+	// they arrive were taken while the charger was offline. They're too
+	// old for the live metrics, which Prometheus would consider stale
+	// anyway.
+	backfillAge = 5 * time.Minute
+	// Late readings are kept for this long.
+	historyRetention = 90 * 24 * time.Hour
+)
+
+// The defaults for sampled value fields the charger leaves out.
+const (
+	defaultMeasurand = "Energy.Active.Import.Register"
+	defaultLocation  = "Outlet"
+	defaultContext   = "Sample.Periodic"
+)
+
+var chargerMeterSignedValues = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "charger_meter_signed_values_total",
+}, []string{"chargepoint"})
+
+var (
+	meterValueDesc = prometheus.NewDesc("charger_meter_value", "", []string{"chargepoint", "connector", "measurand", "phase", "location", "context"}, nil)
+	// The energy registers are the charger's own counters, exported as
+	// such. The context doesn't matter for a register.
+	registerDescs = map[string]*prometheus.Desc{
+		"Energy.Active.Import.Register":   prometheus.NewDesc("charger_energy_active_import_wh_total", "", []string{"chargepoint", "connector", "phase", "location"}, nil),
+		"Energy.Active.Export.Register":   prometheus.NewDesc("charger_energy_active_export_wh_total", "", []string{"chargepoint", "connector", "phase", "location"}, nil),
+		"Energy.Reactive.Import.Register": prometheus.NewDesc("charger_energy_reactive_import_varh_total", "", []string{"chargepoint", "connector", "phase", "location"}, nil),
+		"Energy.Reactive.Export.Register": prometheus.NewDesc("charger_energy_reactive_export_varh_total", "", []string{"chargepoint", "connector", "phase", "location"}, nil),
+	}
+)
+
+// sample is a sampled value from a charger.
+type sample struct {
+	Measurand string
+	Phase     string
+	Location  string
+	Context   string
+	Unit      string
+	Value     float64
+	Timestamp time.Time
+}
+
+// meterSeries is the latest value of a meter series, in base units.
+type meterSeries struct {
+	ChargePoint string    `json:"chargePoint"`
+	Connector   int       `json:"connector"`
+	Measurand   string    `json:"measurand"`
+	Phase       string    `json:"phase"`
+	Location    string    `json:"location"`
+	Context     string    `json:"context"`
+	Value       float64   `json:"value"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (s *meterSeries) key() string {
+	ctx := s.Context
+	if _, ok := registerDescs[s.Measurand]; ok {
+		ctx = ""
+	}
+	return strings.Join([]string{s.ChargePoint, strconv.Itoa(s.Connector), s.Measurand, s.Phase, s.Location, ctx}, "\x01")
+}
+
+// meterStore keeps the latest meter values and exports them, optionally
+// with the time the charger took the reading, and keeps the readings sent
+// late as history.
+type meterStore struct {
+	db         *leveldb.DB
+	timestamps bool
+	mut        sync.Mutex
+	series     map[string]meterSeries
+}
+
+func newMeterStore(db *leveldb.DB, timestamps bool) (*meterStore, error) {
+	m := &meterStore{db: db, timestamps: timestamps, series: make(map[string]meterSeries)}
+	it := db.NewIterator(util.BytesPrefix([]byte(meterPrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		var s meterSeries
+		if err := json.Unmarshal(it.Value(), &s); err != nil {
+			return nil, err
+		}
+		m.series[s.key()] = s
+	}
+	return m, it.Error()
+}
+
+// Record sets the meter value for a sampled value, unless we have a newer
+// one, or stores it in the history if it was sent late, given when the
+// charger connected. If the value is the energy import register, the
+// reading in Wh is returned for the transaction.
+func (m *meterStore) Record(chargePoint string, connected time.Time, connector int, sv sample) (int, bool) {
+	if sv.Timestamp.IsZero() {
+		sv.Timestamp = time.Now()
+	}
+	s := meterSeries{
+		ChargePoint: chargePoint,
+		Connector:   connector,
+		Measurand:   withDefault(sv.Measurand, defaultMeasurand),
+		Phase:       sv.Phase,
+		Location:    withDefault(sv.Location, defaultLocation),
+		Context:     withDefault(sv.Context, defaultContext),
+		Value:       baseUnitValue(sv.Unit, sv.Value),
+		Timestamp:   sv.Timestamp.UTC(),
+	}
+	slog.Debug("Set meter value", "id", chargePoint, "connector", connector, "measurand", s.Measurand, "phase", s.Phase, "location", s.Location, "context", s.Context, "val", s.Value)
+
+	if isBackfill(s.Timestamp, connected) {
+		m.storeHistory(s)
+	} else {
+		m.setLatest(s)
+		if ha != nil {
+			ha.Meter(s)
+		}
+	}
+
+	if s.Measurand != defaultMeasurand || s.Phase != "" || s.Location != defaultLocation {
+		return 0, false
+	}
+	return int(s.Value), true
+}
+
+func (m *meterStore) setLatest(s meterSeries) {
+	key := s.key()
+	m.mut.Lock()
+	prev, ok := m.series[key]
+	if ok && s.Timestamp.Before(prev.Timestamp) {
+		m.mut.Unlock()
+		return
+	}
+	m.series[key] = s
+	m.mut.Unlock()
+	if ok && prev.Value == s.Value && prev.Context == s.Context {
+		// Only the timestamp has changed; that can wait for the next
+		// value.
+		return
+	}
+	if bs, err := json.Marshal(s); err == nil {
+		if err := m.db.Put([]byte(meterPrefix+key), bs, nil); err != nil {
+			slog.Error("Failed to store meter value", "id", s.ChargePoint, "err", err)
+		}
+	}
+}
+
+// storeHistory stores a late reading, and drops the charge point's
+// readings older than the retention.
+func (m *meterStore) storeHistory(s meterSeries) {
+	slog.Debug("Storing late meter value", "id", s.ChargePoint, "measurand", s.Measurand, "timestamp", s.Timestamp)
+	prefix := []byte(historyPrefix + s.ChargePoint + "\x00")
+	key := binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(s.Timestamp.UnixNano()))
+	key = append(key, s.key()...)
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	if err := m.db.Put(key, bs, nil); err != nil {
+		slog.Error("Failed to store meter history", "id", s.ChargePoint, "err", err)
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	it := m.db.NewIterator(&util.Range{
+		Start: prefix,
+		Limit: binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(time.Now().Add(-historyRetention).UnixNano())),
+	}, nil)
+	for it.Next() {
+		batch.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := m.db.Write(batch, nil); err != nil {
+		slog.Error("Failed to prune meter history", "id", s.ChargePoint, "err", err)
+	}
+}
+
+// History returns up to limit of the charge point's readings that were
+// sent late, taken in the time range, oldest first.
+func (m *meterStore) History(chargePoint string, from, to time.Time, limit int) ([]meterSeries, error) {
+	prefix := []byte(historyPrefix + chargePoint + "\x00")
+	rng := &util.Range{
+		Start: binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(from.UnixNano())),
+		Limit: binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(to.UnixNano())),
+	}
+	it := m.db.NewIterator(rng, nil)
+	defer it.Release()
+	res := []meterSeries{}
+	for it.Next() && len(res) < limit {
+		var s meterSeries
+		if err := json.Unmarshal(it.Value(), &s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, it.Error()
+}
+
+// isBackfill returns whether a reading taken at t, from a charger that
+// connected at connected, is from when the charger was offline. Recent
+// readings are live regardless, so that a charger with a slow clock gets
+// back to live values once its clock is past the reconnect.
+func isBackfill(t, connected time.Time) bool {
+	return t.Before(connected) && time.Since(t) > backfillAge
+}
+
+func (m *meterStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- meterValueDesc
+	for _, d := range registerDescs {
+		ch <- d
+	}
+}
+
+func (m *meterStore) Collect(ch chan<- prometheus.Metric) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, s := range m.series {
+		connector := strconv.Itoa(s.Connector)
+		var metric prometheus.Metric
+		if d, ok := registerDescs[s.Measurand]; ok {
+			metric = prometheus.MustNewConstMetric(d, prometheus.CounterValue, s.Value, s.ChargePoint, connector, s.Phase, s.Location)
+		} else {
+			metric = prometheus.MustNewConstMetric(meterValueDesc, prometheus.GaugeValue, s.Value, s.ChargePoint, connector, s.Measurand, s.Phase, s.Location, s.Context)
+		}
+		if m.timestamps {
+			metric = prometheus.NewMetricWithTimestamp(s.Timestamp, metric)
+		}
+		ch <- metric
+	}
+}
+
+// baseUnitValue converts a value to the base unit: Wh, varh, W, var, VA,
+// and degrees Celsius. Other units are as they come.
+func baseUnitValue(unit string, val float64) float64 {
+	switch unit {
+	case "kWh", "kvarh", "kW", "kvar", "kVA":
+		return val * 1000
+	case "Fahrenheit":
+		return (val - 32) * 5 / 9
+	case "K":
+		return val - 273.15
+	default:
+		return val
+	}
+}
+
+func withDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
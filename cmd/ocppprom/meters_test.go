@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestMeterStore(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := newMeterStore(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := time.Now()
+
+	if wh, ok := m.Record("cp1", connected, 1, sample{Unit: "kWh", Value: 1.5}); !ok || wh != 1500 {
+		t.Errorf("default register gave %d, %v", wh, ok)
+	}
+	// The register is the same series in another context.
+	m.Record("cp1", connected, 1, sample{Measurand: "Energy.Active.Import.Register", Context: "Transaction.End", Unit: "Wh", Value: 1600})
+	if _, ok := m.Record("cp1", connected, 1, sample{Measurand: "Energy.Active.Import.Register", Phase: "L1", Value: 500}); ok {
+		t.Error("phase register taken for the transaction")
+	}
+	m.Record("cp1", connected, 1, sample{Measurand: "Power.Active.Import", Unit: "kW", Value: 3.7})
+	m.Record("cp1", connected, 1, sample{Measurand: "Temperature", Location: "Body", Unit: "Fahrenheit", Value: 212})
+
+	expected := `
+# HELP charger_energy_active_import_wh_total
+# TYPE charger_energy_active_import_wh_total counter
+charger_energy_active_import_wh_total{chargepoint="cp1",connector="1",location="Outlet",phase=""} 1600
+charger_energy_active_import_wh_total{chargepoint="cp1",connector="1",location="Outlet",phase="L1"} 500
+# HELP charger_meter_value
+# TYPE charger_meter_value gauge
+charger_meter_value{chargepoint="cp1",connector="1",context="Sample.Periodic",location="Body",measurand="Temperature",phase=""} 100
+charger_meter_value{chargepoint="cp1",connector="1",context="Sample.Periodic",location="Outlet",measurand="Power.Active.Import",phase=""} 3700
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// The values are there after a restart.
+	m, err = newMeterStore(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(m); n != 4 {
+		t.Errorf("expected 4 series after reload, got %d", n)
+	}
+}
+
+func TestMeterHistory(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := newMeterStore(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	m.Record("cp1", now, 1, sample{Value: 2000, Timestamp: now})
+	// Readings from while the charger was offline, sent after it
+	// reconnected.
+	m.Record("cp1", now, 1, sample{Value: 1000, Timestamp: now.Add(-2 * time.Hour)})
+	m.Record("cp1", now, 1, sample{Value: 1500, Context: "Sample.Clock", Timestamp: now.Add(-time.Hour)})
+	m.Record("cp2", now, 1, sample{Value: 1, Timestamp: now.Add(-time.Hour)})
+	// A charger with a slow clock is live once it's connected for longer
+	// than it's behind.
+	if wh, ok := m.Record("cp3", now.Add(-20*time.Minute), 1, sample{Value: 3000, Timestamp: now.Add(-10 * time.Minute)}); !ok || wh != 3000 {
+		t.Errorf("slow clock reading gave %d, %v", wh, ok)
+	}
+	// Readings past the retention are dropped.
+	m.Record("cp1", now, 1, sample{Value: 10, Timestamp: now.Add(-historyRetention - time.Hour)})
+
+	var me io_prometheus_client.Metric
+	ch := make(chan prometheus.Metric, 2)
+	m.Collect(ch)
+	close(ch)
+	live := map[string]float64{}
+	for metric := range ch {
+		if err := metric.Write(&me); err != nil {
+			t.Fatal(err)
+		}
+		live[me.GetLabel()[0].GetValue()] = me.GetCounter().GetValue()
+		if me.GetLabel()[0].GetValue() == "cp1" && me.GetTimestampMs() != now.UnixMilli() {
+			t.Errorf("live value at %d", me.GetTimestampMs())
+		}
+	}
+	if len(live) != 2 || live["cp1"] != 2000 || live["cp3"] != 3000 {
+		t.Errorf("live values %v", live)
+	}
+
+	hist, err := m.History("cp1", time.Unix(0, 0), now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 2 || hist[0].Value != 1000 || hist[1].Value != 1500 || hist[1].Context != "Sample.Clock" {
+		t.Errorf("unexpected history %+v", hist)
+	}
+	if hist, _ := m.History("cp1", now.Add(-90*time.Minute), now, 10); len(hist) != 1 {
+		t.Errorf("expected one reading in range, got %+v", hist)
+	}
+}
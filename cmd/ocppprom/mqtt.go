@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"calmh.dev/hassmqtt"
+	"calmh.dev/homeprom/internal/fanout"
+	v16 "github.com/aliml92/ocpp/v16"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Home Assistant sees each charge point as a device with sensors for its
+// state and what it draws, a switch to start and stop charging, and a
+// number for the current limit. hassmqtt only does sensors, so the switch
+// and number get discovery messages of our own.
+
+const haTopicPrefix = "ocppprom"
+
+type haSensor struct {
+	name        string
+	deviceClass string
+	unit        string
+	stateClass  string
+}
+
+var haSensors = map[string]haSensor{
+	"state":          {"State", "", "", ""},
+	"session_energy": {"Session energy", "energy", "Wh", "total"},
+	"power":          {"Power", "power", "W", "measurement"},
+	"current_l1":     {"Current L1", "current", "A", "measurement"},
+	"current_l2":     {"Current L2", "current", "A", "measurement"},
+	"current_l3":     {"Current L3", "current", "A", "measurement"},
+}
+
+type haUpdate struct {
+	chargePoint string
+	entity      string
+	value       any
+}
+
+type homeAssistant struct {
+	opts            *mqtt.ClientOptions
+	discoveryPrefix string
+	idTag           string
+	maxCurrent      float64
+
+	outbox    *fanout.Fanout[haUpdate]
+	sensors   map[string]*hassmqtt.Metric
+	announced map[string]bool
+}
+
+func newHomeAssistant(cli *CLI) *homeAssistant {
+	opts := mqttOptions(cli)
+	opts.SetClientID(hassmqtt.ClientID("ocppprom"))
+	h := &homeAssistant{
+		opts:            opts,
+		discoveryPrefix: cli.HADiscoveryPrefix,
+		idTag:           cli.HAIDTag,
+		maxCurrent:      cli.MaxCurrent,
+		outbox:          fanout.New[haUpdate](),
+		sensors:         make(map[string]*hassmqtt.Metric),
+		announced:       make(map[string]bool),
+	}
+	if h.maxCurrent <= 0 {
+		h.maxCurrent = 32
+	}
+	return h
+}
+
+func (h *homeAssistant) Serve(ctx context.Context) error {
+	slog.Info("Connecting to MQTT", "broker", h.opts.Servers[0], "client_id", h.opts.ClientID)
+	// Subscribe again on every reconnect, as the session may be gone.
+	h.opts.SetOnConnectHandler(func(c mqtt.Client) {
+		topic := haTopicPrefix + "/+/+/set"
+		if token := c.Subscribe(topic, 0, h.handleCommand); token.Wait() && token.Error() != nil {
+			slog.Error("Failed to subscribe", "topic", topic, "err", token.Error())
+		}
+	})
+	client := mqtt.NewClient(h.opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		slog.Error("Failed to connect to MQTT", "broker", h.opts.Servers[0], "client_id", h.opts.ClientID, "error", err)
+		return fmt.Errorf("failed to connect: %s", err) // intentionally not wrapped
+	}
+	defer client.Disconnect(250)
+
+	// As with hanprom, stale values are better dropped than sent late.
+	sub := h.outbox.Listen(fanout.Options{Buffer: 100, Policy: fanout.DropOldest})
+	defer sub.Close()
+
+	for {
+		select {
+		case u, ok := <-sub.Channel():
+			if !ok {
+				return nil
+			}
+			if err := h.publish(client, u); err != nil {
+				slog.Error("Failed to publish to MQTT", "broker", h.opts.Servers[0], "client_id", h.opts.ClientID, "error", err)
+				return fmt.Errorf("failed to publish: %s", err) // intentionally not wrapped
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Status publishes a connector status. Only the first connector is
+// published, as that's the one that matters for the chargers we have.
+func (h *homeAssistant) Status(chargePoint string, connector int, status string) {
+	if connector == 1 {
+		_ = h.outbox.Publish(haUpdate{chargePoint, "state", status})
+	}
+}
+
+// Meter publishes the meter values that have a sensor.
+func (h *homeAssistant) Meter(s meterSeries) {
+	if s.Connector > 1 || s.Location != defaultLocation {
+		return
+	}
+	switch {
+	case s.Measurand == "Power.Active.Import" && s.Phase == "":
+		_ = h.outbox.Publish(haUpdate{s.ChargePoint, "power", s.Value})
+	case s.Measurand == "Current.Import" && (s.Phase == "L1" || s.Phase == "L2" || s.Phase == "L3"):
+		_ = h.outbox.Publish(haUpdate{s.ChargePoint, "current_" + strings.ToLower(s.Phase), s.Value})
+	}
+}
+
+// Session publishes the energy of the transaction and whether it's
+// ongoing.
+func (h *homeAssistant) Session(t *transaction) {
+	_ = h.outbox.Publish(haUpdate{t.ChargePoint, "session_energy", t.EnergyWh()})
+	_ = h.outbox.Publish(haUpdate{t.ChargePoint, "charging", onOff(t.Stopped == nil)})
+}
+
+func (h *homeAssistant) CurrentLimit(chargePoint string, amperes float64) {
+	_ = h.outbox.Publish(haUpdate{chargePoint, "current_limit", amperes})
+}
+
+func (h *homeAssistant) publish(client mqtt.Client, u haUpdate) error {
+	if !h.announced[u.chargePoint] {
+		if err := h.announce(client, u.chargePoint); err != nil {
+			return err
+		}
+		h.announced[u.chargePoint] = true
+	}
+
+	if _, ok := haSensors[u.entity]; ok {
+		return h.sensors[u.chargePoint+"/"+u.entity].Publish(client, u.value)
+	}
+	token := client.Publish(h.topic(u.chargePoint, u.entity), 0, true, fmt.Sprint(u.value))
+	token.Wait()
+	return token.Error()
+}
+
+// announce sets up the charge point's sensors and publishes the discovery
+// messages for its switch and number.
+func (h *homeAssistant) announce(client mqtt.Client, chargePoint string) error {
+	dev := &hassmqtt.Device{
+		Namespace: "ocpp",
+		ClientID:  h.opts.ClientID,
+		ID:        chargePoint,
+		Name:      chargePoint,
+	}
+	for id, s := range haSensors {
+		h.sensors[chargePoint+"/"+id] = &hassmqtt.Metric{
+			Device:      dev,
+			ID:          id,
+			DeviceType:  "sensor",
+			DeviceClass: s.deviceClass,
+			StateClass:  s.stateClass,
+			Unit:        s.unit,
+			Name:        s.name,
+		}
+	}
+
+	device := map[string]any{"identifiers": []string{"ocpp-" + chargePoint}, "name": chargePoint}
+	configs := map[string]map[string]any{
+		"switch/charging": {
+			"name":          "Charging",
+			"icon":          "mdi:ev-station",
+			"state_topic":   h.topic(chargePoint, "charging"),
+			"command_topic": h.topic(chargePoint, "charging") + "/set",
+		},
+		"number/current_limit": {
+			"name":                "Current limit",
+			"device_class":        "current",
+			"unit_of_measurement": "A",
+			"min":                 0,
+			"max":                 h.maxCurrent,
+			"step":                1,
+			"state_topic":         h.topic(chargePoint, "current_limit"),
+			"command_topic":       h.topic(chargePoint, "current_limit") + "/set",
+		},
+	}
+	for path, cfg := range configs {
+		component, id, _ := strings.Cut(path, "/")
+		cfg["unique_id"] = "ocppprom-" + chargePoint + "-" + id
+		cfg["device"] = device
+		bs, err := json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		topic := fmt.Sprintf("%s/%s/ocppprom-%s/%s/config", h.discoveryPrefix, component, chargePoint, id)
+		token := client.Publish(topic, 0, true, bs)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *homeAssistant) topic(chargePoint, entity string) string {
+	return haTopicPrefix + "/" + chargePoint + "/" + entity
+}
+
+// handleCommand turns a switch or number change in Home Assistant into
+// calls to the charge point.
+func (h *homeAssistant) handleCommand(_ mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 4 {
+		return
+	}
+	id, entity, payload := parts[1], parts[2], strings.TrimSpace(string(msg.Payload()))
+	slog.Info("Home Assistant command", "id", id, "entity", entity, "payload", payload)
+	cp, ok := chargePoints.Get(id)
+	if !ok || cp.proto != ocppV16 {
+		slog.Warn("Home Assistant command for unavailable charge point", "id", id)
+		return
+	}
+
+	// Off the MQTT client's goroutine, as the calls wait for the charger.
+	switch entity {
+	case "charging":
+		go h.setCharging(cp, payload == "ON")
+	case "current_limit":
+		limit, err := strconv.ParseFloat(payload, 64)
+		if err != nil || limit < 0 {
+			slog.Error("Bad current limit", "id", id, "payload", payload)
+			return
+		}
+		go h.setCurrentLimit(cp, limit)
+	default:
+		slog.Warn("Unknown Home Assistant command", "id", id, "entity", entity)
+	}
+}
+
+// setCharging starts a transaction with our idTag on the first connector,
+// or stops the ongoing ones.
+func (h *homeAssistant) setCharging(cp *chargePoint, on bool) {
+	active := transactions.Active(cp.ID)
+	if on {
+		if len(active) > 0 {
+			return
+		}
+		connector := 1
+		var conf v16.RemoteStartTransactionConf
+		if err := cp.Call("RemoteStartTransaction", v16.RemoteStartTransactionReq{ConnectorId: &connector, IdTag: h.idTag}, &conf); err != nil || conf.Status != "Accepted" {
+			slog.Error("Failed to start charging", "id", cp.ID, "status", conf.Status, "err", err)
+			_ = h.outbox.Publish(haUpdate{cp.ID, "charging", onOff(false)})
+		}
+		return
+	}
+	for _, t := range active {
+		var conf v16.RemoteStopTransactionConf
+		if err := cp.Call("RemoteStopTransaction", v16.RemoteStopTransactionReq{TransactionId: t.ID}, &conf); err != nil || conf.Status != "Accepted" {
+			slog.Error("Failed to stop charging", "id", cp.ID, "transaction", t.ID, "status", conf.Status, "err", err)
+			_ = h.outbox.Publish(haUpdate{cp.ID, "charging", onOff(true)})
+		}
+	}
+}
+
+// setCurrentLimit caps the charger's current. With smart charging the cap
+// applies on top of the computed limit.
+func (h *homeAssistant) setCurrentLimit(cp *chargePoint, limit float64) {
+	if smart != nil {
+		smart.SetCap(cp, limit)
+		return
+	}
+	if err := sendCurrentLimit(cp, limit); err != nil {
+		slog.Error("Failed to set charging profile", "id", cp.ID, "err", err)
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
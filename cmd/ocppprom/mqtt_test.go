@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"calmh.dev/homeprom/internal/fanout"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHomeAssistantCharging(t *testing.T) {
+	conn := setupCSMS(t)("cp1", ocppV16)
+	h := newHomeAssistant(&CLI{MQTTBroker: "tcp://localhost:1883", HAIDTag: "ha"})
+	sub := h.outbox.Listen(fanout.Options{Buffer: 10})
+	defer sub.Close()
+
+	cp, ok := chargePoints.Get("cp1")
+	if !ok {
+		t.Fatal("not connected")
+	}
+	done := make(chan struct{})
+	go func() {
+		h.setCharging(cp, true)
+		close(done)
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame []json.RawMessage
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	var uid, action string
+	_ = json.Unmarshal(frame[1], &uid)
+	_ = json.Unmarshal(frame[2], &action)
+	if action != "RemoteStartTransaction" || string(frame[3]) != `{"connectorId":1,"idTag":"ha"}` {
+		t.Errorf("unexpected call %s %s", action, frame[3])
+	}
+	if err := conn.WriteJSON([]any{3, uid, map[string]string{"status": "Rejected"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// The switch goes back off when the charger won't start.
+	select {
+	case u := <-sub.Channel():
+		if u.entity != "charging" || u.value != "OFF" {
+			t.Errorf("unexpected update %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Error("switch state not published")
+	}
+
+	h.Meter(meterSeries{ChargePoint: "cp1", Connector: 1, Measurand: "Current.Import", Phase: "L2", Location: defaultLocation, Value: 16})
+	select {
+	case u := <-sub.Channel():
+		if u.entity != "current_l2" || u.value != 16.0 {
+			t.Errorf("unexpected update %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Error("current not published")
+	}
+
+	// With smart charging, the cap is sent straight away.
+	t.Cleanup(restore(&smart))
+	smart = &smartCharging{maxCurrent: 16, minCurrent: 6, sent: map[string]float64{}, caps: map[string]float64{}}
+	done = make(chan struct{})
+	go func() {
+		h.setCurrentLimit(cp, 10)
+		close(done)
+	}()
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	_ = json.Unmarshal(frame[1], &uid)
+	_ = json.Unmarshal(frame[2], &action)
+	var req setChargingProfileReq
+	_ = json.Unmarshal(frame[3], &req)
+	if action != "SetChargingProfile" || req.CsChargingProfiles.ChargingSchedule.ChargingSchedulePeriod[0].Limit != 10 {
+		t.Errorf("unexpected call %s %s", action, frame[3])
+	}
+	if err := conn.WriteJSON([]any{3, uid, map[string]string{"status": "Accepted"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if v := testutil.ToFloat64(chargerCurrentLimit.WithLabelValues("cp1")); v != 10 {
+		t.Errorf("current limit %v", v)
+	}
+}
+
+// fakeMQTT records what's published.
+type fakeMQTT struct {
+	mqtt.Client
+	published map[string][]byte
+}
+
+func (f *fakeMQTT) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	f.published[topic] = payload.([]byte)
+	return &mqtt.DummyToken{}
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	h := newHomeAssistant(&CLI{MQTTBroker: "tcp://localhost:1883", HADiscoveryPrefix: "homeassistant", MaxCurrent: 16})
+	client := &fakeMQTT{published: map[string][]byte{}}
+	if err := h.announce(client, "cp1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.sensors) != len(haSensors) {
+		t.Errorf("%d sensors set up", len(h.sensors))
+	}
+
+	cases := []struct {
+		topic   string
+		command string
+		max     any
+	}{
+		{"homeassistant/switch/ocppprom-cp1/charging/config", "ocppprom/cp1/charging/set", nil},
+		{"homeassistant/number/ocppprom-cp1/current_limit/config", "ocppprom/cp1/current_limit/set", 16.0},
+	}
+	for _, c := range cases {
+		var cfg map[string]any
+		if err := json.Unmarshal(client.published[c.topic], &cfg); err != nil {
+			t.Errorf("%s: %v", c.topic, err)
+			continue
+		}
+		if cfg["command_topic"] != c.command || cfg["max"] != c.max {
+			t.Errorf("%s: unexpected config %v", c.topic, cfg)
+		}
+		if dev, _ := cfg["device"].(map[string]any); dev["name"] != "cp1" {
+			t.Errorf("%s: unexpected device %v", c.topic, cfg["device"])
+		}
+	}
+	if len(client.published) != len(cases) {
+		t.Errorf("published %d discovery messages", len(client.published))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+)
+
+// OCPP 2.0.1 messages, with our own types as the ocpp library's don't pass
+// its own validation. We only answer what the charger sends by itself,
+// mapped onto the same metrics and transactions as OCPP 1.6, with the EVSE
+// standing in for the connector. Configuration, local lists, smart charging
+// and remote control remain OCPP 1.6 only.
+
+var handlers201 = map[string]handler{
+	"Authorize":                  cast(authorize201),
+	"BootNotification":           cast(bootNotification201),
+	"DataTransfer":               cast(dataTransfer201),
+	"FirmwareStatusNotification": cast(firmwareStatusNotification201),
+	"Heartbeat":                  cast(heartbeat201),
+	"MeterValues":                cast(meterValues201),
+	"NotifyEvent":                acknowledge("NotifyEvent"),
+	"SecurityEventNotification":  acknowledge("SecurityEventNotification"),
+	"StatusNotification":         cast(statusNotification201),
+	"TransactionEvent":           cast(transactionEvent201),
+}
+
+// The 2.0.1 connector statuses and transaction charging states, as the
+// OCPP 1.6 status that means the same thing.
+var (
+	connectorStatus201 = map[string]string{
+		"Available":   "Available",
+		"Occupied":    "Preparing",
+		"Reserved":    "Reserved",
+		"Unavailable": "Unavailable",
+		"Faulted":     "Faulted",
+	}
+	chargingState201 = map[string]string{
+		"EVConnected":   "Preparing",
+		"Charging":      "Charging",
+		"SuspendedEV":   "SuspendedEV",
+		"SuspendedEVSE": "SuspendedEVSE",
+	}
+)
+
+type idToken201 struct {
+	IdToken string `json:"idToken"`
+	Type    string `json:"type"`
+}
+
+type idTokenInfo201 struct {
+	Status string `json:"status"`
+}
+
+type sampledValue201 struct {
+	Value         float64 `json:"value"`
+	Measurand     string  `json:"measurand,omitempty"`
+	Phase         string  `json:"phase,omitempty"`
+	Location      string  `json:"location,omitempty"`
+	Context       string  `json:"context,omitempty"`
+	UnitOfMeasure struct {
+		Unit       string `json:"unit,omitempty"`
+		Multiplier int    `json:"multiplier,omitempty"`
+	} `json:"unitOfMeasure"`
+}
+
+type meterValue201 struct {
+	Timestamp    string            `json:"timestamp"`
+	SampledValue []sampledValue201 `json:"sampledValue"`
+}
+
+type authorizeReq201 struct {
+	IdToken idToken201 `json:"idToken"`
+}
+
+type authorizeRes201 struct {
+	IdTokenInfo idTokenInfo201 `json:"idTokenInfo"`
+}
+
+func authorize201(cp *chargePoint, p *authorizeReq201) *authorizeRes201 {
+	return &authorizeRes201{IdTokenInfo: authorizeToken201(cp, p.IdToken)}
+}
+
+func authorizeToken201(cp *chargePoint, token idToken201) idTokenInfo201 {
+	// The tag's expiry date isn't the cacheExpiryDateTime, which is how long
+	// the station may cache the answer, so that stays unset.
+	return idTokenInfo201{Status: tags.Authorize(cp.ID, token.IdToken).Status}
+}
+
+type bootNotificationReq201 struct {
+	Reason          string `json:"reason"`
+	ChargingStation struct {
+		SerialNumber string `json:"serialNumber"`
+		Model        string `json:"model"`
+		VendorName   string `json:"vendorName"`
+	} `json:"chargingStation"`
+}
+
+type bootNotificationRes201 struct {
+	CurrentTime string `json:"currentTime"`
+	Interval    int    `json:"interval"`
+	Status      string `json:"status"`
+}
+
+func bootNotification201(cp *chargePoint, p *bootNotificationReq201) *bootNotificationRes201 {
+	recordBoot(cp.ID, ocppV201, p.ChargingStation.VendorName, p.ChargingStation.Model, p.ChargingStation.SerialNumber)
+	return &bootNotificationRes201{
+		CurrentTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Interval:    heartbeatInterval,
+		Status:      "Accepted",
+	}
+}
+
+type dataTransferReq201 struct {
+	VendorId  string `json:"vendorId"`
+	MessageId string `json:"messageId,omitempty"`
+}
+
+type dataTransferRes201 struct {
+	Status string `json:"status"`
+}
+
+func dataTransfer201(cp *chargePoint, p *dataTransferReq201) *dataTransferRes201 {
+	slog.Debug("DataTransfer", "id", cp.ID, "p", p)
+	return &dataTransferRes201{Status: "Accepted"}
+}
+
+type heartbeatRes201 struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+func heartbeat201(cp *chargePoint, _ *struct{}) *heartbeatRes201 {
+	recordHeartbeat(cp.ID)
+	return &heartbeatRes201{CurrentTime: time.Now().UTC().Format(time.RFC3339Nano)}
+}
+
+type meterValuesReq201 struct {
+	EvseId     int             `json:"evseId"`
+	MeterValue []meterValue201 `json:"meterValue"`
+}
+
+func meterValues201(cp *chargePoint, p *meterValuesReq201) *struct{} {
+	slog.Debug("MeterValues", "id", cp.ID, "p", p)
+	recordMeterValues201(cp, p.EvseId, p.MeterValue)
+	return &struct{}{}
+}
+
+// recordMeterValues201 sets the meter value metrics and returns the last
+// energy register reading, in Wh, if there was one.
+func recordMeterValues201(cp *chargePoint, evse int, mvs []meterValue201) (int, bool) {
+	var wh int
+	var haveWh bool
+	for _, mv := range mvs {
+		when := parseTime(mv.Timestamp)
+		for _, sv := range mv.SampledValue {
+			val := sv.Value * math.Pow10(sv.UnitOfMeasure.Multiplier)
+			v, ok := meters.Record(cp.ID, cp.connected, evse, sample{
+				Measurand: sv.Measurand,
+				Phase:     sv.Phase,
+				Location:  sv.Location,
+				Context:   sv.Context,
+				Unit:      sv.UnitOfMeasure.Unit,
+				Value:     val,
+				Timestamp: when,
+			})
+			if ok {
+				wh, haveWh = v, true
+			}
+		}
+	}
+	return wh, haveWh
+}
+
+type statusNotificationReq201 struct {
+	Timestamp       string `json:"timestamp"`
+	ConnectorStatus string `json:"connectorStatus"`
+	EvseId          int    `json:"evseId"`
+	ConnectorId     int    `json:"connectorId"`
+}
+
+func statusNotification201(cp *chargePoint, p *statusNotificationReq201) *struct{} {
+	status, ok := connectorStatus201[p.ConnectorStatus]
+	if !ok {
+		status = p.ConnectorStatus
+	}
+	recordStatus(cp.ID, p.EvseId, status, "")
+	return &struct{}{}
+}
+
+type transactionEventReq201 struct {
+	EventType       string `json:"eventType"`
+	Timestamp       string `json:"timestamp"`
+	TriggerReason   string `json:"triggerReason"`
+	SeqNo           int    `json:"seqNo"`
+	TransactionInfo struct {
+		TransactionId string `json:"transactionId"`
+		ChargingState string `json:"chargingState,omitempty"`
+		StoppedReason string `json:"stoppedReason,omitempty"`
+	} `json:"transactionInfo"`
+	IdToken *idToken201 `json:"idToken,omitempty"`
+	Evse    *struct {
+		Id int `json:"id"`
+	} `json:"evse,omitempty"`
+	MeterValue []meterValue201 `json:"meterValue,omitempty"`
+}
+
+type transactionEventRes201 struct {
+	IdTokenInfo *idTokenInfo201 `json:"idTokenInfo,omitempty"`
+}
+
+// transactionEvent201 maps the transaction events onto the start, update
+// and stop of OCPP 1.6. Events can be lost or resent, so any event of an
+// unknown transaction starts it, and events of a stopped one are ignored.
+func transactionEvent201(cp *chargePoint, p *transactionEventReq201) *transactionEventRes201 {
+	ref := p.TransactionInfo.TransactionId
+	when := parseTime(p.Timestamp)
+	res := &transactionEventRes201{}
+	var idTag string
+	if p.IdToken != nil {
+		idTag = p.IdToken.IdToken
+		info := authorizeToken201(cp, *p.IdToken)
+		res.IdTokenInfo = &info
+	}
+
+	t, known := transactions.Find(cp.ID, ref)
+	if known && t.Stopped != nil {
+		slog.Debug("Event of stopped transaction", "id", cp.ID, "transaction", t.ID, "event", p.EventType)
+		return res
+	}
+	// The EVSE is only given in the first event that knows it.
+	evse := t.Connector
+	if p.Evse != nil {
+		evse = p.Evse.Id
+	}
+
+	wh, haveWh := recordMeterValues201(cp, evse, p.MeterValue)
+	if state, ok := chargingState201[p.TransactionInfo.ChargingState]; ok {
+		if p.EventType == "Ended" {
+			// Still plugged in.
+			state = "Finishing"
+		}
+		recordStatus(cp.ID, evse, state, "")
+	}
+
+	if !known {
+		nt, err := transactions.Start(cp.ID, evse, idTag, wh, when, ref)
+		if err != nil {
+			slog.Error("Failed to store transaction", "id", cp.ID, "err", err)
+			return res
+		}
+		slog.Info("Start transaction", "id", cp.ID, "connector", evse, "transaction", nt.ID, "ref", ref, "meter", wh)
+		t = *nt
+	}
+
+	switch p.EventType {
+	case "Ended":
+		if !haveWh {
+			wh = t.MeterLast
+		}
+		st, err := transactions.Stop(cp.ID, t.ID, wh, when, p.TransactionInfo.StoppedReason)
+		if err != nil {
+			slog.Error("Failed to store transaction", "id", cp.ID, "transaction", t.ID, "err", err)
+			return res
+		}
+		slog.Info("Stop transaction", "id", cp.ID, "transaction", st.ID, "meter", wh, "energy", st.EnergyWh(), "reason", p.TransactionInfo.StoppedReason)
+	default:
+		if haveWh {
+			if err := transactions.Update(t.ID, wh); err != nil {
+				slog.Debug("Failed to update transaction", "id", cp.ID, "transaction", t.ID, "err", err)
+			}
+		}
+	}
+	return res
+}
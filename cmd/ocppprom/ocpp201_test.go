@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// restore returns a function that puts back the current value of *p.
+func restore[T any](p *T) func() {
+	v := *p
+	return func() { *p = v }
+}
+
+// setupCSMS sets up the global state, restored when the test ends, serves
+// charge point connections, and returns a function to connect as a
+// charger.
+func setupCSMS(t *testing.T) func(id string, protos ...string) *websocket.Conn {
+	t.Helper()
+	for _, f := range []func(){
+		restore(&transactions), restore(&tags), restore(&passwords), restore(&maintenance),
+		restore(&meters), restore(&chargerState), restore(&chargerLastHeartbeat),
+		restore(&chargePoints), restore(&chargerConfigs),
+	} {
+		t.Cleanup(f)
+	}
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	transactions, err = newTransactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags = newTagStore(db)
+	passwords = newPasswordStore(db, false)
+	maintenance, err = newMaintenanceStore(db, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chargerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "charger_state"}, []string{"chargepoint", "connector"})
+	meters, err = newMeterStore(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chargerLastHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "charger_last_heartbeat_seconds"}, []string{"chargepoint"})
+	chargePoints = &registry{cps: make(map[string]*chargePoint)}
+	chargerConfigs = &chargerConfig{}
+
+	srv := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	t.Cleanup(srv.Close)
+
+	return func(id string, protos ...string) *websocket.Conn {
+		t.Helper()
+		hdr := http.Header{}
+		hdr.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(id+":")))
+		dialer := websocket.Dialer{Subprotocols: protos}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/"+id, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if len(protos) == 1 && conn.Subprotocol() != protos[0] {
+			t.Fatalf("negotiated %q", conn.Subprotocol())
+		}
+		return conn
+	}
+}
+
+func TestOCPP201(t *testing.T) {
+	conn := setupCSMS(t)("cs1", ocppV201)
+
+	call := func(action, payload string) []json.RawMessage {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`[2,"1","`+action+`",`+payload+`]`)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame []json.RawMessage
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	res := call("BootNotification", `{"reason":"PowerUp","chargingStation":{"model":"M","vendorName":"V"}}`)
+	if string(res[0]) != "3" || !strings.Contains(string(res[2]), `"status":"Accepted"`) {
+		t.Errorf("boot: %s", res)
+	}
+	unknown := chargerMessagesReceived.WithLabelValues("cs1", "unknown", "NotImplemented")
+	before := testutil.ToFloat64(unknown)
+	if res := call("GetBaseReport", `{}`); string(res[0]) != "4" || string(res[2]) != `"NotImplemented"` {
+		t.Errorf("unknown action: %s", res)
+	}
+	if v := testutil.ToFloat64(unknown) - before; v != 1 {
+		t.Errorf("unanswered call counted %v times", v)
+	}
+	if v := testutil.ToFloat64(chargerConnected.WithLabelValues("cs1")); v != 1 {
+		t.Errorf("not connected")
+	}
+
+	call("StatusNotification", `{"timestamp":"2024-01-02T03:04:05Z","connectorStatus":"Occupied","evseId":1,"connectorId":1}`)
+	if v := testutil.ToFloat64(chargerState.WithLabelValues("cs1", "1")); v != 2 {
+		t.Errorf("occupied is state %v, expected Preparing", v)
+	}
+
+	// The seqNo 0 Started event, which the library couldn't take.
+	res = call("TransactionEvent", `{"eventType":"Started","timestamp":"2024-01-02T03:04:05Z","triggerReason":"Authorized","seqNo":0,
+		"transactionInfo":{"transactionId":"abc","chargingState":"Charging"},"idToken":{"idToken":"unknown","type":"ISO14443"},"evse":{"id":1},
+		"meterValue":[{"timestamp":"2024-01-02T03:04:05Z","sampledValue":[{"value":1000,"context":"Transaction.Begin"}]}]}`)
+	if !strings.Contains(string(res[2]), `"status":"Invalid"`) {
+		t.Errorf("unknown tag: %s", res)
+	}
+	call("TransactionEvent", `{"eventType":"Updated","timestamp":"2024-01-02T03:14:05Z","triggerReason":"MeterValuePeriodic","seqNo":1,
+		"transactionInfo":{"transactionId":"abc","chargingState":"Charging"},
+		"meterValue":[{"timestamp":"2024-01-02T03:14:05Z","sampledValue":[{"value":2.5,"measurand":"Energy.Active.Import.Register","unitOfMeasure":{"unit":"kWh"}}]}]}`)
+	ended := `{"eventType":"Ended","timestamp":"2024-01-02T04:04:05Z","triggerReason":"StopAuthorized","seqNo":2,
+		"transactionInfo":{"transactionId":"abc","chargingState":"EVConnected","stoppedReason":"Local"},
+		"meterValue":[{"timestamp":"2024-01-02T04:04:05Z","sampledValue":[{"value":30,"unitOfMeasure":{"multiplier":2}}]}]}`
+	call("TransactionEvent", ended)
+	call("TransactionEvent", ended)
+
+	ts, err := transactions.Recent(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 1 {
+		t.Fatalf("expected one transaction, got %+v", ts)
+	}
+	if tx := ts[0]; tx.Ref != "abc" || tx.Connector != 1 || tx.Stopped == nil || tx.EnergyWh() != 2000 || tx.StopReason != "Local" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+	if v := testutil.ToFloat64(chargerState.WithLabelValues("cs1", "1")); v != 6 {
+		t.Errorf("ended is state %v, expected Finishing", v)
+	}
+}
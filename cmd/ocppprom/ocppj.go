@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The OCPP-J connection to a charger, with calls in both directions as
+// JSON over the websocket. The ocpp library can't parse some of what real
+// chargers send, so we handle the connection ourselves and use the library
+// only for the OCPP 1.6 message types.
+
+const (
+	ocppV16  = "ocpp1.6"
+	ocppV201 = "ocpp2.0.1"
+)
+
+// OCPP-J message types.
+const (
+	messageCall       = 2
+	messageCallResult = 3
+	messageCallError  = 4
+)
+
+const (
+	// The heartbeat interval we give chargers.
+	heartbeatInterval = 60
+	// How long we wait to hear from a charger before giving up on the
+	// connection.
+	readTimeout  = 3 * heartbeatInterval * time.Second
+	writeTimeout = 10 * time.Second
+	callTimeout  = 20 * time.Second
+)
+
+// The result label for a call answered with a CallResult. Errors are
+// labelled with the OCPP error code, or Timeout and NotConnected when
+// there was no answer.
+const resultOK = "OK"
+
+var (
+	chargerMessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_messages_received_total",
+	}, []string{"chargepoint", "action", "result"})
+	chargerMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_messages_sent_total",
+	}, []string{"chargepoint", "action", "result"})
+	chargerCallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_call_errors_total",
+	}, []string{"chargepoint", "direction", "code"})
+	chargerCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "charger_call_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"chargepoint", "action"})
+	chargerLastSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_last_seen_seconds",
+	}, []string{"chargepoint"})
+)
+
+var (
+	errNotConnected = errors.New("charge point not connected")
+	errCallTimeout  = errors.New("timeout waiting for charge point")
+	errNotAllowed   = errors.New("not allowed while proxying")
+)
+
+// The handlers for calls from the chargers, by protocol and action.
+var handlers = map[string]map[string]handler{
+	ocppV16:  handlers16,
+	ocppV201: handlers201,
+}
+
+type handler func(cp *chargePoint, payload json.RawMessage) (any, error)
+
+// callError is an OCPP error, from a charger or to it.
+type callError struct {
+	Code        string `json:"errorCode"`
+	Description string `json:"errorDescription"`
+	Details     any    `json:"errorDetails"`
+}
+
+func (e *callError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+type callResult struct {
+	payload json.RawMessage
+	err     error
+}
+
+// chargePoint is a connected charger.
+type chargePoint struct {
+	ID        string
+	proto     string
+	conn      *websocket.Conn
+	connected time.Time
+
+	callMut sync.Mutex // OCPP-J allows one outstanding call at a time
+	lastID  int
+
+	mut       sync.Mutex
+	pendingID string
+	pending   chan callResult
+	closed    chan struct{}
+
+	wmut sync.Mutex
+
+	proxy *proxy // nil unless proxied to another CSMS
+
+	// Functions to run once the response to the current call has been
+	// sent. Only used by the reader.
+	later []func()
+}
+
+func newChargePoint(id, proto string, conn *websocket.Conn) *chargePoint {
+	cp := &chargePoint{
+		ID:        id,
+		proto:     proto,
+		conn:      conn,
+		connected: time.Now(),
+		closed:    make(chan struct{}),
+	}
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		cp.wmut.Lock()
+		defer cp.wmut.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+	})
+	return cp
+}
+
+// Serve handles messages from the charger until the connection is lost.
+func (cp *chargePoint) Serve() {
+	defer cp.close()
+	for {
+		_ = cp.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		_, msg, err := cp.conn.ReadMessage()
+		if err != nil {
+			slog.Info("Charge point disconnected", "id", cp.ID, "err", err)
+			return
+		}
+		if frameLog != nil {
+			frameLog.Log(cp.ID, frameIn, msg)
+		}
+		if err := cp.handle(msg); err != nil {
+			slog.Info("Charge point disconnected", "id", cp.ID, "err", err)
+			return
+		}
+	}
+}
+
+func (cp *chargePoint) close() {
+	close(cp.closed)
+	cp.conn.Close()
+}
+
+// Connected returns whether the connection is still up.
+func (cp *chargePoint) Connected() bool {
+	select {
+	case <-cp.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// mayCall returns whether we may make the call to the charger, which for
+// a proxied charger depends on the calls we may inject.
+func (cp *chargePoint) mayCall(action string) bool {
+	return cp.proxy == nil || cp.proxy.mayInject(action)
+}
+
+// Call sends the request to the charger and decodes the response into res,
+// unless that's nil. An error response from the charger is returned as a
+// *callError.
+func (cp *chargePoint) Call(action string, req, res any) error {
+	if !cp.mayCall(action) {
+		// Nothing was sent, so nothing to count.
+		return errNotAllowed
+	}
+	t0 := time.Now()
+	err := cp.call(action, req, res)
+	result := resultOK
+	var callErr *callError
+	switch {
+	case errors.As(err, &callErr):
+		result = callErr.Code
+		chargerCallErrors.WithLabelValues(cp.ID, "received", callErr.Code).Inc()
+	case errors.Is(err, errCallTimeout):
+		result = "Timeout"
+	case errors.Is(err, errNotConnected):
+		result = "NotConnected"
+	}
+	chargerMessagesSent.WithLabelValues(cp.ID, action, result).Inc()
+	if result == resultOK || callErr != nil {
+		chargerCallDuration.WithLabelValues(cp.ID, action).Observe(time.Since(t0).Seconds())
+	}
+	return err
+}
+
+func (cp *chargePoint) call(action string, req, res any) error {
+	cp.callMut.Lock()
+	defer cp.callMut.Unlock()
+
+	cp.lastID++
+	id := strconv.Itoa(cp.lastID)
+	if cp.proxy != nil {
+		// Keep out of the way of the upstream's message IDs.
+		id = "ocppprom-" + id
+		var err error
+		if req, err = cp.proxy.outgoing(req); err != nil {
+			return err
+		}
+	}
+	ch := make(chan callResult, 1)
+	cp.mut.Lock()
+	cp.pendingID, cp.pending = id, ch
+	cp.mut.Unlock()
+	defer func() {
+		cp.mut.Lock()
+		cp.pendingID, cp.pending = "", nil
+		cp.mut.Unlock()
+	}()
+
+	if err := cp.write(messageCall, id, action, req); err != nil {
+		return err
+	}
+	select {
+	case r := <-ch:
+		if r.err != nil || res == nil {
+			return r.err
+		}
+		return json.Unmarshal(r.payload, res)
+	case <-cp.closed:
+		return errNotConnected
+	case <-time.After(callTimeout):
+		return errCallTimeout
+	}
+}
+
+func (cp *chargePoint) handle(msg []byte) error {
+	chargerLastSeen.WithLabelValues(cp.ID).SetToCurrentTime()
+	var frame []json.RawMessage
+	var typ int
+	var uid string
+	if json.Unmarshal(msg, &frame) != nil || len(frame) < 3 || json.Unmarshal(frame[0], &typ) != nil || json.Unmarshal(frame[1], &uid) != nil {
+		slog.Error("Failed to parse message", "id", cp.ID, "msg", string(msg))
+		return nil
+	}
+	if cp.proxy != nil && typ != messageCall && cp.proxy.forwardResult(uid, msg) {
+		// The answer to a call from upstream.
+		return nil
+	}
+
+	switch typ {
+	case messageCall:
+		var action string
+		if err := json.Unmarshal(frame[2], &action); err != nil || len(frame) != 4 {
+			return cp.writeCallError(uid, &callError{Code: "FormationViolation", Description: "malformed call"})
+		}
+		handle := cp.handleCall
+		if cp.proxy != nil {
+			handle = cp.proxy.chargerCall
+		}
+		if err := handle(uid, action, frame[3]); err != nil {
+			return err
+		}
+		cp.runPending()
+
+	case messageCallResult:
+		cp.deliver(uid, callResult{payload: frame[2]})
+
+	case messageCallError:
+		callErr := &callError{}
+		if len(frame) > 2 {
+			_ = json.Unmarshal(frame[2], &callErr.Code)
+		}
+		if len(frame) > 3 {
+			_ = json.Unmarshal(frame[3], &callErr.Description)
+		}
+		if len(frame) > 4 {
+			_ = json.Unmarshal(frame[4], &callErr.Details)
+		}
+		cp.deliver(uid, callResult{err: callErr})
+
+	default:
+		slog.Error("Unknown message type", "id", cp.ID, "msg", string(msg))
+	}
+	return nil
+}
+
+func (cp *chargePoint) handleCall(uid, action string, payload json.RawMessage) error {
+	res, callErr := cp.dispatch(action, payload)
+	if callErr != nil {
+		return cp.writeCallError(uid, callErr)
+	}
+	return cp.write(messageCallResult, uid, res)
+}
+
+// dispatch runs the handler for a call from the charger and returns the
+// response, or the error to answer with.
+func (cp *chargePoint) dispatch(action string, payload json.RawMessage) (any, *callError) {
+	h, ok := handlers[cp.proto][action]
+	if !ok {
+		slog.Error("No handler for action", "id", cp.ID, "action", action)
+		// The action is whatever the charger says, so it doesn't go in a
+		// label.
+		chargerMessagesReceived.WithLabelValues(cp.ID, "unknown", "NotImplemented").Inc()
+		return nil, &callError{Code: "NotImplemented", Description: fmt.Sprintf("Action %s is not implemented", action)}
+	}
+	res, err := h(cp, payload)
+	if err != nil {
+		slog.Error("Failed to handle call", "id", cp.ID, "action", action, "err", err)
+		var callErr *callError
+		if !errors.As(err, &callErr) {
+			callErr = &callError{Code: "InternalError", Description: err.Error()}
+		}
+		chargerMessagesReceived.WithLabelValues(cp.ID, action, callErr.Code).Inc()
+		return nil, callErr
+	}
+	chargerMessagesReceived.WithLabelValues(cp.ID, action, resultOK).Inc()
+	return res, nil
+}
+
+// writeCallError answers the call with the error.
+func (cp *chargePoint) writeCallError(uid string, callErr *callError) error {
+	chargerCallErrors.WithLabelValues(cp.ID, "sent", callErr.Code).Inc()
+	return cp.write(messageCallError, uid, callErr.Code, callErr.Description, struct{}{})
+}
+
+// deliver hands a response to the call waiting for it.
+func (cp *chargePoint) deliver(uid string, res callResult) {
+	cp.mut.Lock()
+	defer cp.mut.Unlock()
+	if cp.pending == nil || uid != cp.pendingID {
+		slog.Warn("Response to unknown call", "id", cp.ID, "uid", uid)
+		return
+	}
+	cp.pending <- res
+	cp.pending = nil
+}
+
+// runLater arranges for fn to run, in the background, once the response
+// to the call being handled has been sent.
+func (cp *chargePoint) runLater(fn func()) {
+	cp.later = append(cp.later, fn)
+}
+
+func (cp *chargePoint) runPending() {
+	for _, fn := range cp.later {
+		go fn()
+	}
+	cp.later = nil
+}
+
+func (cp *chargePoint) write(fields ...any) error {
+	bs, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return cp.writeMessage(bs)
+}
+
+func (cp *chargePoint) writeMessage(bs []byte) error {
+	if !cp.Connected() {
+		return errNotConnected
+	}
+	cp.wmut.Lock()
+	defer cp.wmut.Unlock()
+	if frameLog != nil {
+		frameLog.Log(cp.ID, frameOut, bs)
+	}
+	_ = cp.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return cp.conn.WriteMessage(websocket.TextMessage, bs)
+}
+
+// cast makes a handler of a function taking the decoded request and
+// returning the response. OCPP 1.6 requests are checked against the
+// library's constraints first.
+func cast[R, C any](fn func(cp *chargePoint, p *R) C) handler {
+	return func(cp *chargePoint, payload json.RawMessage) (any, error) {
+		var p R
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, &callError{Code: "FormationViolation", Description: err.Error()}
+		}
+		if cp.proto == ocppV16 {
+			if err := v16.Validate.Struct(&p); err != nil {
+				return nil, &callError{Code: "PropertyConstraintViolation", Description: err.Error()}
+			}
+		}
+		return fn(cp, &p), nil
+	}
+}
+
+// acknowledge makes a handler for a notification we have no use for
+// beyond the debug log.
+func acknowledge(action string) handler {
+	return func(cp *chargePoint, payload json.RawMessage) (any, error) {
+		slog.Debug(action, "id", cp.ID, "p", string(payload))
+		return struct{}{}, nil
+	}
+}
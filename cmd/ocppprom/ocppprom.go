@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -10,25 +14,34 @@ import (
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/aliml92/ocpp"
 	v16 "github.com/aliml92/ocpp/v16"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-isatty"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/thejerf/suture/v4"
 )
 
-var csms *ocpp.Server
+var (
+	transactions   *transactionStore
+	tags           *tagStore
+	meters         *meterStore
+	smart          *smartCharging // nil when not limiting current
+	ha             *homeAssistant // nil without Home Assistant
+	chargerConfigs *chargerConfig
+	maintenance    *maintenanceStore
+	passwords      *passwordStore
+)
 
 var (
 	chargerInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "charger_info",
-	}, []string{"vendor", "model", "serial"})
-	chargerState         prometheus.Gauge
-	chargerMeterValue    *prometheus.GaugeVec
-	chargerLastHeartbeat prometheus.Gauge
+	}, []string{"chargepoint", "vendor", "model", "serial"})
+	chargerState         *prometheus.GaugeVec
+	chargerLastHeartbeat *prometheus.GaugeVec
 )
 
 var chargerStates = []string{"", "Available", "Preparing", "Charging", "SuspendedEV", "SuspendedEVSE", "Finishing", "Reserved", "Unavailable", "Faulted"}
@@ -40,13 +53,75 @@ type CLI struct {
 	ClockAlignedIntervalS int    `default:"900" env:"CLOCK_ALIGNED_INTERVAL_S"`
 	Measurands            string `default:"Energy.Active.Import.Register" env:"MEASURANDS"`
 	MinStatusDurationS    int    `default:"30" env:"MIN_STATUS_DURATION_S"`
+	MeterTimestamps       bool   `env:"METER_TIMESTAMPS" help:"Export meter values with the time the charger took them"`
+	ChargerConfig         string `env:"CHARGER_CONFIG" type:"path" help:"JSON file with configuration profiles for the chargers"`
 	StateDatabase         string `default:"~/ocppprom.db" env:"STATE_DATABASE" type:"path"`
+	APIToken              string `env:"API_TOKEN" help:"Bearer token required for the HTTP API (default none)"`
+	PublicURL             string `env:"PUBLIC_URL" help:"Base URL of the HTTP listener as the chargers reach it, for firmware and diagnostics"`
+	FirmwareDir           string `env:"FIRMWARE_DIR" type:"path" help:"Directory of firmware images to offer the chargers"`
+	DiagnosticsDir        string `env:"DIAGNOSTICS_DIR" type:"path" help:"Directory to store diagnostics uploads in"`
+	FrameLog              string `env:"FRAME_LOG" type:"path" help:"File to log every OCPP frame to, as JSON lines"`
 	Debug                 bool   `env:"DEBUG"`
+
+	MaxCurrent      float64       `env:"MAX_CURRENT" help:"Maximum charging current per charger in A; enables smart charging"`
+	MinCurrent      float64       `default:"6" env:"MIN_CURRENT" help:"Lowest charging current in A; charging pauses when less is available"`
+	CurrentSchedule string        `env:"CURRENT_SCHEDULE" help:"Current limits by time of day, as HH:MM-HH:MM=A,..."`
+	HeadroomTopic   string        `env:"HEADROOM_TOPIC" help:"MQTT topic with the current left on the main fuse, in A"`
+	HeadroomURL     string        `env:"HEADROOM_URL" help:"URL with the current left on the main fuse, in A"`
+	HeadroomMargin  float64       `default:"1" env:"HEADROOM_MARGIN" help:"Current in A to keep unused on the main fuse"`
+	ProfileInterval time.Duration `default:"30s" env:"PROFILE_INTERVAL" help:"How often to recompute the current limit"`
+
+	MQTTBroker   string `help:"MQTT broker address" env:"MQTT_BROKER"`
+	MQTTUsername string `help:"MQTT username" default:"" env:"MQTT_USERNAME"`
+	MQTTPassword string `help:"MQTT password" default:"" env:"MQTT_PASSWORD"`
+
+	HomeAssistant     bool   `env:"HOME_ASSISTANT" help:"Publish the chargers to Home Assistant over MQTT"`
+	HADiscoveryPrefix string `default:"homeassistant" env:"HA_DISCOVERY_PREFIX" help:"Home Assistant MQTT discovery prefix"`
+	HAIDTag           string `name:"ha-idtag" default:"homeassistant" env:"HA_IDTAG" help:"idTag for charging started from Home Assistant; it needs to be in the tag list"`
+
+	RequirePassword      bool   `env:"REQUIRE_PASSWORD" help:"Reject charge points without a password set"`
+	TLSCert              string `env:"OCPP_TLS_CERT" type:"path" help:"Certificate for serving OCPP over TLS"`
+	TLSKey               string `env:"OCPP_TLS_KEY" type:"path" help:"Key for the OCPP TLS certificate"`
+	TLSClientCA          string `env:"OCPP_TLS_CLIENT_CA" type:"path" help:"CA certificates to verify charger client certificates against"`
+	TLSRequireClientCert bool   `env:"OCPP_TLS_REQUIRE_CLIENT_CERT" help:"Reject chargers without a client certificate"`
+
+	Upstream        string        `env:"UPSTREAM" help:"Websocket URL of a CSMS to proxy the chargers to, without the charge point ID"`
+	UpstreamPolicy  string        `default:"upstream" enum:"upstream,local" env:"UPSTREAM_POLICY" help:"Whose responses to the chargers' calls win when proxying"`
+	UpstreamInject  []string      `default:"TriggerMessage,GetConfiguration" env:"UPSTREAM_INJECT" help:"Calls of our own we may make to proxied chargers"`
+	UpstreamTimeout time.Duration `default:"10s" env:"UPSTREAM_TIMEOUT" help:"How long to wait for the upstream's answer before giving the charger ours"`
+
+	Serve         struct{}         `cmd:"" default:"1" help:"Run the central system"`
+	SetPassword   setPasswordCmd   `cmd:"" help:"Set a charge point's basic auth password (with the server stopped)"`
+	ClearPassword clearPasswordCmd `cmd:"" help:"Remove a charge point's basic auth password (with the server stopped)"`
+}
+
+type setPasswordCmd struct {
+	ChargePoint string `arg:""`
+	Password    string `arg:"" optional:"" help:"The password, or empty to generate one"`
+}
+
+func (c *setPasswordCmd) Run(ps *passwordStore) error {
+	if c.Password == "" {
+		var err error
+		if c.Password, err = generatePassword(); err != nil {
+			return err
+		}
+		fmt.Println(c.Password)
+	}
+	return ps.Set(c.ChargePoint, c.Password)
+}
+
+type clearPasswordCmd struct {
+	ChargePoint string `arg:""`
+}
+
+func (c *clearPasswordCmd) Run(ps *passwordStore) error {
+	return ps.Delete(c.ChargePoint)
 }
 
 func main() {
 	var cli CLI
-	kong.Parse(&cli)
+	ctx := kong.Parse(&cli)
 
 	level := slog.LevelInfo
 	if cli.Debug {
@@ -65,211 +140,402 @@ func main() {
 		slog.Error("Failed to open database", "err", err)
 		os.Exit(1)
 	}
+	passwords = newPasswordStore(db, cli.RequirePassword)
+	if ctx.Command() != "serve" {
+		err := ctx.Run(passwords)
+		db.Close()
+		ctx.FatalIfErrorf(err)
+		return
+	}
 
 	pm := newPersistentMetrics(db)
 	go pm.Serve()
-	chargerState = pm.NewGauge(prometheus.GaugeOpts{Name: "charger_state"})
-	chargerMeterValue = pm.NewGaugeVec(prometheus.GaugeOpts{Name: "charger_meter_value"}, []string{"measurand"})
-	chargerLastHeartbeat = pm.NewGauge(prometheus.GaugeOpts{Name: "charger_last_heartbeat"})
+	chargerState = pm.NewGaugeVec(prometheus.GaugeOpts{Name: "charger_state"}, []string{"chargepoint", "connector"})
+	chargerLastHeartbeat = pm.NewGaugeVec(prometheus.GaugeOpts{Name: "charger_last_heartbeat_seconds"}, []string{"chargepoint"})
+	// Milliseconds, from before the above.
+	if err := pm.Forget("charger_last_heartbeat"); err != nil {
+		slog.Warn("Failed to delete old heartbeat metric", "err", err)
+	}
+
+	transactions, err = newTransactionStore(db)
+	if err != nil {
+		slog.Error("Failed to load transactions", "err", err)
+		os.Exit(1)
+	}
+	prometheus.MustRegister(transactions)
+	meters, err = newMeterStore(db, cli.MeterTimestamps)
+	if err != nil {
+		slog.Error("Failed to load meter values", "err", err)
+		os.Exit(1)
+	}
+	prometheus.MustRegister(meters)
+	tags = newTagStore(db)
+	maintenance, err = newMaintenanceStore(db, cli.PublicURL, cli.FirmwareDir, cli.DiagnosticsDir)
+	if err != nil {
+		slog.Error("Failed to load maintenance state", "err", err)
+		os.Exit(1)
+	}
+
+	if cli.MaxCurrent > 0 {
+		smart, err = newSmartCharging(&cli)
+		if err != nil {
+			slog.Error("Failed to set up smart charging", "err", err)
+			os.Exit(1)
+		}
+		if cli.HeadroomTopic != "" {
+			if cli.MQTTBroker == "" {
+				slog.Error("Headroom topic needs an MQTT broker")
+				os.Exit(1)
+			}
+			if err := smart.headroom.Subscribe(mqttOptions(&cli), cli.HeadroomTopic); err != nil {
+				slog.Error("Failed to subscribe to headroom", "err", err)
+				os.Exit(1)
+			}
+		}
+		if cli.HeadroomURL != "" {
+			go smart.headroom.Poll(context.Background(), cli.HeadroomURL, cli.ProfileInterval)
+		}
+		go smart.Serve(context.Background())
+
+		// We need to know what the chargers draw.
+		if !slices.Contains(strings.Split(cli.Measurands, ","), "Current.Import") {
+			cli.Measurands += ",Current.Import"
+		}
+	}
+
+	if cli.HomeAssistant {
+		if cli.MQTTBroker == "" {
+			slog.Error("Home Assistant needs an MQTT broker")
+			os.Exit(1)
+		}
+		ha = newHomeAssistant(&cli)
+		sup := suture.NewSimple("main")
+		sup.Add(ha)
+		sup.ServeBackground(context.Background())
+	}
+
+	if cli.FrameLog != "" {
+		frameLog, err = openFrameLog(cli.FrameLog)
+		if err != nil {
+			slog.Error("Failed to open frame log", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if cli.Upstream != "" {
+		upstream = &proxyConfig{url: cli.Upstream, policy: cli.UpstreamPolicy, inject: cli.UpstreamInject, timeout: cli.UpstreamTimeout}
+	}
 
 	slog.Info("Starting", "ocpp", cli.OCPPListen, "http", cli.HTTPListen)
 
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		if err := http.ListenAndServe(cli.HTTPListen, nil); err != nil {
+		if err := http.ListenAndServe(cli.HTTPListen, newHTTPMux(cli.APIToken)); err != nil {
 			slog.Error("Failed to listen for metrics", "err", err)
 		}
 	}()
 
-	csms = ocpp.NewServer()
-
-	csms.AddSubProtocol("ocpp1.6")
-	csms.SetCheckOriginHandler(func(r *http.Request) bool { return true })
-	csms.SetPreUpgradeHandler(customPreUpgradeHandler)
-	csms.SetCallQueueSize(32)
-
-	csms.On("BootNotification", cast(bootNotification))
-	csms.On("Authorize", cast(authorize))
-	csms.On("DataTransfer", cast(dataTransfer))
-	csms.On("DiagnosticsStatusNotification", cast(diagnosticsStatusNotification))
-	csms.On("FirmwareStatusNotification", cast(firmwareStatusNotification))
-	csms.On("Heartbeat", cast(heartbeat))
-	csms.On("MeterValues", cast(meterValues))
-	csms.On("StartTransaction", cast(startTransaction))
-	csms.On("StatusNotification", cast(statusNotification))
-	csms.On("StopTransaction", cast(stopTransaction))
-
-	cfg := &config{
-		MeterValueSampleIntervalS: cli.SampleIntervalS,
-		ClockAlignedDataIntervalS: cli.ClockAlignedIntervalS,
-		Measurands:                cli.Measurands,
-		MinimumStatusDurationS:    cli.MinStatusDurationS,
-	}
-	csms.After("BootNotification", cfg.changeConfigration)
-
-	csms.Start(cli.OCPPListen, "/ws/", nil)
+	chargerConfigs, err = newChargerConfig(cli.ChargerConfig, map[string]string{
+		"MeterValuesAlignedData":   cli.Measurands,
+		"MeterValuesSampledData":   cli.Measurands,
+		"ClockAlignedDataInterval": strconv.Itoa(cli.ClockAlignedIntervalS),
+		"MeterValueSampleInterval": strconv.Itoa(cli.SampleIntervalS),
+		"MinimumStatusDuration":    strconv.Itoa(cli.MinStatusDurationS),
+	})
+	if err != nil {
+		slog.Error("Failed to load charger configuration", "err", err)
+		os.Exit(1)
+	}
+
+	ocppMux := http.NewServeMux()
+	ocppMux.HandleFunc("/ws/", handleWebsocket)
+	srv := &http.Server{Addr: cli.OCPPListen, Handler: ocppMux}
+	if cli.TLSCert != "" {
+		srv.TLSConfig, err = ocppTLSConfig(&cli)
+		if err != nil {
+			slog.Error("Failed to set up TLS", "err", err)
+			os.Exit(1)
+		}
+		err = srv.ListenAndServeTLS(cli.TLSCert, cli.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		slog.Error("Failed to listen for OCPP", "err", err)
+		os.Exit(1)
+	}
 }
 
-func customPreUpgradeHandler(w http.ResponseWriter, r *http.Request) bool {
-	u, _, ok := r.BasicAuth()
-	if !ok {
-		slog.Error("Error parsing basic auth")
-		w.WriteHeader(401)
-		return false
+// ocppTLSConfig returns the TLS configuration for the OCPP listener, with
+// client certificates verified against the CA if one is given.
+func ocppTLSConfig(cli *CLI) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cli.TLSClientCA == "" {
+		return cfg, nil
 	}
-	path := strings.Split(r.URL.Path, "/")
-	id := path[len(path)-1]
-	if u != id {
-		slog.Error("Username provided is incorrect")
-		w.WriteHeader(401)
-		return false
+	bs, err := os.ReadFile(cli.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("%s: no certificates", cli.TLSClientCA)
 	}
-	return true
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if cli.TLSRequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
 }
 
-func bootNotification(cp *ocpp.ChargePoint, p *v16.BootNotificationReq) *v16.BootNotificationConf {
-	chargerInfo.WithLabelValues(p.ChargePointVendor, p.ChargePointModel, p.ChargePointSerialNumber).Set(1)
-	slog.Info("Charge point connected", "vendor", p.ChargePointVendor, "model", p.ChargePointModel, "serial", p.ChargePointSerialNumber)
-	return &v16.BootNotificationConf{
-		CurrentTime: time.Now().UTC().Format(time.RFC3339Nano),
-		Interval:    60,
-		Status:      "Accepted",
+func mqttOptions(cli *CLI) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cli.MQTTBroker)
+	opts.SetClientID(fmt.Sprintf("ocppprom-%d", os.Getpid()))
+	if cli.MQTTUsername != "" && cli.MQTTPassword != "" {
+		opts.SetUsername(cli.MQTTUsername)
+		opts.SetPassword(cli.MQTTPassword)
 	}
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(5 * time.Second)
+	opts.SetWriteTimeout(5 * time.Second)
+	return opts
 }
 
-type config struct {
-	MeterValueSampleIntervalS int
-	ClockAlignedDataIntervalS int
-	MinimumStatusDurationS    int
-	Measurands                string
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{ocppV16, ocppV201},
+	CheckOrigin:  func(r *http.Request) bool { return true },
 }
 
-func (c *config) changeConfigration(cp *ocpp.ChargePoint, _ ocpp.Payload) {
-	type changeConfigurationReq struct {
-		Key   string `json:"key" validate:"required,max=50"`
-		Value string `json:"value" validate:"required,max=500"`
-	}
-	reqs := []changeConfigurationReq{
-		{Key: "MeterValuesAlignedData", Value: c.Measurands},
-		{Key: "MeterValuesSampledData", Value: c.Measurands},
-		{Key: "ClockAlignedDataInterval", Value: strconv.Itoa(c.ClockAlignedDataIntervalS)},
-		{Key: "MeterValueSampleInterval", Value: strconv.Itoa(c.MeterValueSampleIntervalS)},
-		{Key: "MinimumStatusDuration", Value: strconv.Itoa(c.MinimumStatusDurationS)},
+// handleWebsocket accepts charge point connections and serves them until
+// they disconnect.
+func handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(w, r) {
+		return
 	}
-	for _, req := range reqs {
-		res, err := cp.Call("ChangeConfiguration", req)
-		if err != nil {
-			slog.Error("Failed to change configuration", "key", req.Key, "val", req.Value, "err", err)
-			continue
-		}
-		if conf, ok := res.(*v16.ChangeConfigurationConf); !ok {
-			slog.Error("Response of bad type", "res", res)
-			continue
-		} else if conf.Status != "Accepted" {
-			slog.Error("Failed to change configuration", "key", req.Key, "val", req.Value, "status", conf.Status)
-		} else {
-			slog.Debug("Set config", "key", req.Key, "val", req.Value)
+	id := chargePointID(r)
+
+	// When proxying, the charger speaks whatever protocol the upstream
+	// picked. Without the upstream we serve the charger ourselves.
+	var up *websocket.Conn
+	u := upgrader
+	if upstream != nil {
+		conn, err := upstream.dial(r, id)
+		switch {
+		case err != nil:
+			slog.Warn("Failed to connect upstream, serving locally", "id", id, "err", err)
+		case conn.Subprotocol() == "":
+			slog.Warn("Upstream chose no subprotocol, serving locally", "id", id)
+			conn.Close()
+		default:
+			up = conn
+			u.Subprotocols = []string{conn.Subprotocol()}
+			defer up.Close()
 		}
 	}
 
-	res, err := cp.Call("TriggerMessage", v16.TriggerMessageReq{RequestedMessage: "MeterValues"})
+	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
-		slog.Error("Failed to trigger message", "err", err)
+		slog.Error("Failed to upgrade connection", "err", err)
+		return
+	}
+	proto := conn.Subprotocol()
+	if proto == "" {
+		slog.Error("No supported subprotocol", "id", id, "offered", websocket.Subprotocols(r))
+		conn.Close()
+		return
+	}
+	cp := newChargePoint(id, proto, conn)
+	if up != nil {
+		cp.proxy = newProxy(upstream, cp, up)
+		go cp.proxy.serve()
+	}
+	chargePoints.add(cp)
+	defer chargePoints.remove(cp)
+	cp.Serve()
+}
+
+func chargePointID(r *http.Request) string {
+	path := strings.Split(r.URL.Path, "/")
+	return path[len(path)-1]
+}
+
+var handlers16 = map[string]handler{
+	"Authorize":                     cast(authorize),
+	"BootNotification":              cast(bootNotification),
+	"DataTransfer":                  cast(dataTransfer),
+	"DiagnosticsStatusNotification": cast(diagnosticsStatusNotification),
+	"FirmwareStatusNotification":    cast(firmwareStatusNotification),
+	"Heartbeat":                     cast(heartbeat),
+	"MeterValues":                   cast(meterValues),
+	"StartTransaction":              cast(startTransaction),
+	"StatusNotification":            cast(statusNotification),
+	"StopTransaction":               cast(stopTransaction),
+}
+
+func bootNotification(cp *chargePoint, p *v16.BootNotificationReq) *v16.BootNotificationConf {
+	recordBoot(cp.ID, ocppV16, p.ChargePointVendor, p.ChargePointModel, p.ChargePointSerialNumber)
+	cp.runLater(func() { afterBoot(cp, p.ChargePointVendor, p.ChargePointModel) })
+	return &v16.BootNotificationConf{
+		CurrentTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Interval:    heartbeatInterval,
+		Status:      "Accepted",
+	}
+}
+
+// afterBoot brings a charger that just booted up to date with what we want
+// of it, as far as we may when it's proxied.
+func afterBoot(cp *chargePoint, vendor, model string) {
+	chargerConfigs.Apply(cp, vendor, model)
+	syncLocalList(cp)
+	if smart != nil {
+		smart.apply(cp, smart.capped(cp.ID, smart.limit(time.Now())))
 	}
-	if conf, ok := res.(*v16.TriggerMessageConf); !ok {
-		slog.Error("Response of bad type", "res", res)
+
+	if !cp.mayCall("TriggerMessage") {
+		return
+	}
+	var conf v16.TriggerMessageConf
+	if err := cp.Call("TriggerMessage", v16.TriggerMessageReq{RequestedMessage: "MeterValues"}, &conf); err != nil {
+		slog.Error("Failed to trigger message", "id", cp.ID, "err", err)
 	} else if conf.Status != "Accepted" {
-		slog.Error("Failed to trigger message", "status", conf.Status)
+		slog.Error("Failed to trigger message", "id", cp.ID, "status", conf.Status)
 	} else {
-		slog.Debug("Triggered meter values message")
+		slog.Debug("Triggered meter values message", "id", cp.ID)
 	}
 }
 
-func authorize(cp *ocpp.ChargePoint, p *v16.AuthorizeReq) *v16.AuthorizeConf {
+func authorize(cp *chargePoint, p *v16.AuthorizeReq) *v16.AuthorizeConf {
 	return &v16.AuthorizeConf{
-		IdTagInfo: v16.IdTagInfo{
-			Status: "Accepted",
-		},
+		IdTagInfo: tags.Authorize(cp.ID, p.IdTag),
 	}
 }
 
-func dataTransfer(cp *ocpp.ChargePoint, p *v16.DataTransferReq) *v16.DataTransferConf {
+func dataTransfer(cp *chargePoint, p *v16.DataTransferReq) *v16.DataTransferConf {
 	slog.Debug("DataTransfer", "p", p)
 	return &v16.DataTransferConf{
 		Status: "Accepted",
 	}
 }
 
-func diagnosticsStatusNotification(cp *ocpp.ChargePoint, p *v16.DiagnosticsStatusNotificationReq) *v16.DiagnosticsStatusNotificationConf {
-	slog.Debug("DiagnosticsStatusNotification", "p", p)
-	return &v16.DiagnosticsStatusNotificationConf{}
-}
-
-func firmwareStatusNotification(cp *ocpp.ChargePoint, p *v16.FirmwareStatusNotificationReq) *v16.FirmwareStatusNotificationConf {
-	slog.Debug("FirmwareStatusNotification", "p", p)
-	return &v16.FirmwareStatusNotificationConf{}
-}
-
-func heartbeat(cp *ocpp.ChargePoint, p *v16.HeartbeatReq) *v16.HeartbeatConf {
-	chargerLastHeartbeat.Set(float64(time.Now().UnixNano() / int64(time.Millisecond)))
+func heartbeat(cp *chargePoint, p *v16.HeartbeatReq) *v16.HeartbeatConf {
+	recordHeartbeat(cp.ID)
 	return &v16.HeartbeatConf{
 		CurrentTime: time.Now().UTC().Format(time.RFC3339Nano),
 	}
 }
 
-func meterValues(cp *ocpp.ChargePoint, p *v16.MeterValuesReq) *v16.MeterValuesConf {
-	slog.Debug("MeterValues", "p", p)
+func meterValues(cp *chargePoint, p *v16.MeterValuesReq) *v16.MeterValuesConf {
+	slog.Debug("MeterValues", "id", cp.ID, "p", p)
+	connector := ptrv(p.ConnectorId)
 	for _, mv := range p.MeterValue {
+		when := parseTime(mv.Timestamp)
 		for _, sv := range mv.SampledValue {
-			key := strings.Join([]string{sv.Measurand, sv.Phase, sv.Unit}, "/")
+			if sv.Format == "SignedData" {
+				// A signed blob for verifying the reading, not a number.
+				slog.Debug("Ignoring signed meter value", "id", cp.ID, "measurand", sv.Measurand)
+				chargerMeterSignedValues.WithLabelValues(cp.ID).Inc()
+				continue
+			}
 			val, err := strconv.ParseFloat(sv.Value, 64)
 			if err != nil {
-				slog.Error("Failed to parse meter value", "key", key, "val", sv.Value, "err", err)
+				slog.Error("Failed to parse meter value", "id", cp.ID, "measurand", sv.Measurand, "val", sv.Value, "err", err)
 				continue
 			}
-			key = strings.ReplaceAll(key, "//", "/")
-			slog.Debug("Set meter value", "key", key, "val", val)
-			chargerMeterValue.WithLabelValues(key).Set(val)
+			wh, isEnergy := meters.Record(cp.ID, cp.connected, connector, sample{
+				Measurand: sv.Measurand,
+				Phase:     sv.Phase,
+				Location:  sv.Location,
+				Context:   sv.Context,
+				Unit:      sv.Unit,
+				Value:     val,
+				Timestamp: when,
+			})
+
+			if smart != nil && sv.Measurand == "Current.Import" && (sv.Unit == "" || sv.Unit == "A") && !isBackfill(when, cp.connected) {
+				smart.ObserveCurrent(cp.ID, val)
+			}
+
+			if p.TransactionId != 0 && isEnergy {
+				if err := transactions.Update(p.TransactionId, wh); err != nil {
+					slog.Debug("Failed to update transaction", "id", cp.ID, "transaction", p.TransactionId, "err", err)
+				}
+			}
 		}
 	}
 	return &v16.MeterValuesConf{}
 }
 
-func startTransaction(cp *ocpp.ChargePoint, p *v16.StartTransactionReq) *v16.StartTransactionConf {
-	slog.Info("Start transaction", "meter", ptrv(p.MeterStart))
+func startTransaction(cp *chargePoint, p *v16.StartTransactionReq) *v16.StartTransactionConf {
+	// The transaction is recorded even if the tag isn't accepted; the
+	// charger is expected to stop it right away.
+	info := tags.Authorize(cp.ID, p.IdTag)
+	t, err := transactions.Start(cp.ID, p.ConnectorId, p.IdTag, ptrv(p.MeterStart), parseTime(p.Timestamp), "")
+	if err != nil {
+		// The charger needs a transaction ID regardless, and will send
+		// its stop with it; that gets recorded as an unknown transaction.
+		slog.Error("Failed to store transaction", "id", cp.ID, "err", err)
+		return &v16.StartTransactionConf{
+			IdTagInfo:     info,
+			TransactionId: transactions.ReserveID(),
+		}
+	}
+	slog.Info("Start transaction", "id", cp.ID, "connector", p.ConnectorId, "transaction", t.ID, "meter", ptrv(p.MeterStart))
 	return &v16.StartTransactionConf{
-		IdTagInfo: v16.IdTagInfo{
-			Status: "Accepted",
-		},
-		TransactionId: int(time.Now().Unix()),
+		IdTagInfo:     info,
+		TransactionId: t.ID,
 	}
 }
 
-func statusNotification(cp *ocpp.ChargePoint, p *v16.StatusNotificationReq) *v16.StatusNotificationConf {
-	idx := slices.Index(chargerStates, p.Status)
-	slog.Info("Status notification", "status", p.Status, "statusIdx", idx, "info", p.Info)
-	chargerState.Set(float64(idx))
+func statusNotification(cp *chargePoint, p *v16.StatusNotificationReq) *v16.StatusNotificationConf {
+	recordStatus(cp.ID, ptrv(p.ConnectorId), p.Status, p.Info)
 	return &v16.StatusNotificationConf{}
 }
 
-func stopTransaction(cp *ocpp.ChargePoint, p *v16.StopTransactionReq) *v16.StopTransactionConf {
-	slog.Info("Stop transaction", "meter", ptrv(p.MeterStop), "reason", p.Reason)
+func stopTransaction(cp *chargePoint, p *v16.StopTransactionReq) *v16.StopTransactionConf {
+	t, err := transactions.Stop(cp.ID, p.TransactionId, ptrv(p.MeterStop), parseTime(p.Timestamp), p.Reason)
+	if err != nil {
+		slog.Error("Failed to store transaction", "id", cp.ID, "transaction", p.TransactionId, "err", err)
+	} else {
+		slog.Info("Stop transaction", "id", cp.ID, "transaction", t.ID, "meter", ptrv(p.MeterStop), "energy", t.EnergyWh(), "reason", p.Reason)
+	}
+	info := v16.IdTagInfo{Status: "Accepted"}
+	if p.IdTag != "" {
+		info = tags.Authorize(cp.ID, p.IdTag)
+	}
 	return &v16.StopTransactionConf{
-		IdTagInfo: v16.IdTagInfo{
-			Status: "Accepted",
-		},
+		IdTagInfo: info,
 	}
 }
 
-func cast[R, C any](fn func(cp *ocpp.ChargePoint, p R) C) func(cp *ocpp.ChargePoint, p ocpp.Payload) ocpp.Payload {
-	return func(cp *ocpp.ChargePoint, p ocpp.Payload) ocpp.Payload {
-		r, ok := p.(R)
-		if !ok {
-			slog.Error("Failed to cast", "p", p, "r", new(R))
-			return nil
-		}
-		return fn(cp, r)
+// The record functions update the metrics from what a charger reports, in
+// the terms of OCPP 1.6 regardless of the version the charger speaks.
+
+func recordBoot(chargePoint, protocol, vendor, model, serial string) {
+	chargerInfo.WithLabelValues(chargePoint, vendor, model, serial).Set(1)
+	slog.Info("Charge point connected", "id", chargePoint, "protocol", protocol, "vendor", vendor, "model", model, "serial", serial)
+}
+
+func recordHeartbeat(chargePoint string) {
+	chargerLastHeartbeat.WithLabelValues(chargePoint).Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+func recordStatus(chargePoint string, connector int, status, info string) {
+	idx := slices.Index(chargerStates, status)
+	slog.Info("Status notification", "id", chargePoint, "connector", connector, "status", status, "statusIdx", idx, "info", info)
+	chargerState.WithLabelValues(chargePoint, strconv.Itoa(connector)).Set(float64(idx))
+	if ha != nil {
+		ha.Status(chargePoint, connector, status)
+	}
+}
+
+// parseTime parses a charger timestamp, falling back to the current time
+// for chargers that don't know what time it is.
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.Year() < 2000 {
+		return time.Now()
 	}
+	return t
 }
 
 func ptrv(p *int) int {
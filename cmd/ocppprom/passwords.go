@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const passwordPrefix = "password\x00"
+
+// The password length OCPP allows for basic auth.
+const (
+	minPasswordLength = 16
+	maxPasswordLength = 40
+)
+
+// The reason label is all we know about whoever failed; the charge point
+// ID is theirs to make up.
+var chargerAuthRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "charger_auth_rejections_total",
+}, []string{"reason"})
+
+var errNoPassword = errors.New("no password set")
+
+// passwordHash is a salted SHA-256 of the password. The passwords are
+// long random strings per the OCPP security profiles, so there's nothing
+// to gain from a slow hash.
+type passwordHash struct {
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+func hashPassword(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// passwordStore keeps the charge points' basic auth passwords in the
+// database. Charge points without a password are let in with any, unless
+// passwords are required.
+type passwordStore struct {
+	db       *leveldb.DB
+	required bool
+}
+
+func newPasswordStore(db *leveldb.DB, required bool) *passwordStore {
+	return &passwordStore{db: db, required: required}
+}
+
+func (s *passwordStore) Set(chargePoint, password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(passwordHash{Salt: salt, Hash: hashPassword(salt, password)})
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(passwordPrefix+chargePoint), bs, nil)
+}
+
+func (s *passwordStore) Delete(chargePoint string) error {
+	return s.db.Delete([]byte(passwordPrefix+chargePoint), nil)
+}
+
+// Verify returns whether the password is the charge point's, or
+// errNoPassword if it has none.
+func (s *passwordStore) Verify(chargePoint, password string) (bool, error) {
+	bs, err := s.db.Get([]byte(passwordPrefix+chargePoint), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return false, errNoPassword
+	} else if err != nil {
+		return false, err
+	}
+	var ph passwordHash
+	if err := json.Unmarshal(bs, &ph); err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hashPassword(ph.Salt, password), ph.Hash) == 1, nil
+}
+
+// generatePassword returns a random password of the longest length OCPP
+// allows.
+func generatePassword() (string, error) {
+	bs := make([]byte, maxPasswordLength*3/4)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// authenticate checks that the connecting charger is the charge point in
+// the path: by its client certificate when it has one (security profile
+// 3), otherwise by basic auth (profiles 1 and 2).
+func authenticate(w http.ResponseWriter, r *http.Request) bool {
+	id := chargePointID(r)
+	reject := func(reason string) bool {
+		slog.Warn("Rejected charge point", "id", id, "remote", r.RemoteAddr, "reason", reason)
+		chargerAuthRejections.WithLabelValues(reason).Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="ocpp"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		// The TLS handshake has verified the certificate against our CA.
+		if r.TLS.VerifiedChains[0][0].Subject.CommonName != id {
+			return reject("certificate_mismatch")
+		}
+		return true
+	}
+
+	u, pw, ok := r.BasicAuth()
+	if !ok {
+		return reject("no_credentials")
+	}
+	if u != id {
+		return reject("wrong_username")
+	}
+	match, err := passwords.Verify(id, pw)
+	switch {
+	case errors.Is(err, errNoPassword):
+		if passwords.required {
+			return reject("no_password_set")
+		}
+		return true
+	case err != nil:
+		slog.Error("Failed to verify password", "id", id, "err", err)
+		return reject("internal_error")
+	case !match:
+		return reject("wrong_password")
+	}
+	return true
+}
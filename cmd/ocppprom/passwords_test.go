@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"calmh.dev/homeprom/internal/testcert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuthenticate(t *testing.T) {
+	setupCSMS(t)
+	if err := passwords.Set("cp1", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+	if err := passwords.Set("cp1", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		id, user, password string
+		ok                 bool
+		reason             string
+	}{
+		{"cp1", "cp1", "0123456789abcdef", true, ""},
+		{"cp1", "cp1", "0123456789abcdeX", false, "wrong_password"},
+		{"cp1", "cp2", "0123456789abcdef", false, "wrong_username"},
+		{"cp2", "cp2", "anything", true, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ws/"+c.id, nil)
+		r.SetBasicAuth(c.user, c.password)
+		before := testutil.ToFloat64(chargerAuthRejections.WithLabelValues(c.reason))
+		w := httptest.NewRecorder()
+		if ok := authenticate(w, r); ok != c.ok {
+			t.Errorf("%+v: got %v", c, ok)
+		}
+		if !c.ok && testutil.ToFloat64(chargerAuthRejections.WithLabelValues(c.reason)) != before+1 {
+			t.Errorf("%+v: rejection not counted", c)
+		}
+	}
+
+	// Without a password set, when they're required.
+	passwords.required = true
+	r := httptest.NewRequest(http.MethodGet, "/ws/cp2", nil)
+	r.SetBasicAuth("cp2", "anything")
+	if authenticate(httptest.NewRecorder(), r) {
+		t.Error("charge point without password accepted")
+	}
+}
+
+func TestAuthenticateTLS(t *testing.T) {
+	setupCSMS(t)
+	files := testcert.New(t)
+	serverCert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1 := files.Client(t, "cp1")
+	untrusted := testcert.Untrusted(t, "cp1")
+
+	cases := []struct {
+		name    string
+		require bool
+		id      string
+		cert    *tls.Certificate
+		status  int // zero when the handshake fails
+		reason  string
+	}{
+		{"certificate", false, "cp1", &cp1, http.StatusOK, ""},
+		{"another charger's certificate", false, "cp2", &cp1, http.StatusUnauthorized, "certificate_mismatch"},
+		{"password instead", false, "cp3", nil, http.StatusOK, ""},
+		{"untrusted certificate", false, "cp1", &untrusted, 0, ""},
+		{"certificate required", true, "cp3", nil, 0, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := ocppTLSConfig(&CLI{TLSClientCA: files.CA, TLSRequireClientCert: c.require})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Certificates = []tls.Certificate{serverCert}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if authenticate(w, r) {
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			srv.TLS = cfg
+			srv.StartTLS()
+			defer srv.Close()
+
+			clientCfg := &tls.Config{
+				RootCAs: files.Pool(),
+				// Send the certificate even when it's not from a CA the
+				// server asks for.
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if c.cert == nil {
+						return &tls.Certificate{}, nil
+					}
+					return c.cert, nil
+				},
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/ws/"+c.id, nil)
+			req.SetBasicAuth(c.id, "")
+			before := testutil.ToFloat64(chargerAuthRejections.WithLabelValues(c.reason))
+			resp, err := client.Do(req)
+			if c.status == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("handshake succeeded with status %d", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.status {
+				t.Errorf("status %d, expected %d", resp.StatusCode, c.status)
+			}
+			if c.reason != "" && testutil.ToFloat64(chargerAuthRejections.WithLabelValues(c.reason)) != before+1 {
+				t.Error("rejection not counted")
+			}
+		})
+	}
+}
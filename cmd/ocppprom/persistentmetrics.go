@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"log/slog"
 	"math"
+	"slices"
 	"strings"
 	"time"
 
@@ -32,7 +33,7 @@ func (p *persistentMetrics) NewGaugeVec(opts prometheus.GaugeOpts, labels []stri
 	gv := promauto.NewGaugeVec(opts, labels)
 	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
 	p.collectors[name] = gv
-	p.loadMultiple(name, func(labels []string) adder { return gv.WithLabelValues(labels...) })
+	p.loadMultiple(name, labels, func(labels []string) adder { return gv.WithLabelValues(labels...) })
 
 	return gv
 }
@@ -41,7 +42,7 @@ func (p *persistentMetrics) NewCounterVec(opts prometheus.CounterOpts, labels []
 	gv := promauto.NewCounterVec(opts, labels)
 	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
 	p.collectors[name] = gv
-	p.loadMultiple(name, func(labels []string) adder { return gv.WithLabelValues(labels...) })
+	p.loadMultiple(name, labels, func(labels []string) adder { return gv.WithLabelValues(labels...) })
 
 	return gv
 }
@@ -78,18 +79,48 @@ func (p *persistentMetrics) loadSingle(name string, g adder) {
 	}
 }
 
-func (p *persistentMetrics) loadMultiple(name string, gfn func(labels []string) adder) {
+func (p *persistentMetrics) loadMultiple(name string, labelNames []string, gfn func(labels []string) adder) {
+	// Label values are stored in the order the collector writes them,
+	// which is sorted by label name, and need to go back into the
+	// declared order.
+	sorted := slices.Sorted(slices.Values(labelNames))
+
 	baseKey := name + "\x00"
 	it := p.db.NewIterator(util.BytesPrefix([]byte(baseKey)), nil)
 	defer it.Release()
 	for it.Next() {
-		_, labels := p.parseKey(it.Key())
+		_, stored := p.parseKey(it.Key())
+		if len(stored) != len(labelNames) {
+			// Stored by a version with different labels, and not to be
+			// stored again.
+			slog.Debug("deleting", "name", name, "labels", stored)
+			_ = p.db.Delete(it.Key(), nil)
+			continue
+		}
+		labels := make([]string, len(labelNames))
+		for i, label := range sorted {
+			labels[slices.Index(labelNames, label)] = stored[i]
+		}
 		val := math.Float64frombits(binary.BigEndian.Uint64(it.Value()))
 		slog.Debug("setting", "name", name, "labels", labels, "val", val)
 		gfn(labels).Add(val)
 	}
 }
 
+// Forget deletes what is stored for a metric that is no longer kept.
+func (p *persistentMetrics) Forget(name string) error {
+	it := p.db.NewIterator(util.BytesPrefix([]byte(name+"\x00")), nil)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	for it.Next() {
+		batch.Delete(it.Key())
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return p.db.Write(batch, nil)
+}
+
 func (p *persistentMetrics) Serve() {
 	for range time.NewTicker(15 * time.Second).C {
 		ch := make(chan nameWrappedMetric)
@@ -128,8 +159,14 @@ func nameWrapMetric(name string, out chan nameWrappedMetric) chan prometheus.Met
 	return ch
 }
 
+// parseKey returns the metric name and label values of the key. A key
+// without label values is taken to be an unlabelled metric's, which is
+// indistinguishable from a single empty label value.
 func (p *persistentMetrics) parseKey(key []byte) (name string, labels []string) {
 	name, labelsPart, _ := strings.Cut(string(key), "\x00")
+	if labelsPart == "" {
+		return name, nil
+	}
 	labels = strings.Split(labelsPart, "\x01")
 	return name, labels
 }
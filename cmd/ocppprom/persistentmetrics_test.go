@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPersistentMetricsLabels(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pm := newPersistentMetrics(db)
+	// Stored label values are sorted by label name, here the reverse of
+	// the declared order.
+	if err := pm.putFloat64("test_meter", []string{"1", "Energy", "cp1"}, 42); err != nil {
+		t.Fatal(err)
+	}
+	// Stored before the labels were added.
+	if err := pm.putFloat64("test_meter", []string{"Energy"}, 17); err != nil {
+		t.Fatal(err)
+	}
+
+	gv := pm.NewGaugeVec(prometheus.GaugeOpts{Name: "test_meter"}, []string{"point", "measurand", "connector"})
+	t.Cleanup(func() { prometheus.Unregister(gv) })
+	if got := testutil.ToFloat64(gv.WithLabelValues("cp1", "Energy", "1")); got != 42 {
+		t.Errorf("loaded %v, expected 42", got)
+	}
+	if n := testutil.CollectAndCount(gv); n != 1 {
+		t.Errorf("loaded %d series, expected 1", n)
+	}
+	if _, err := db.Get([]byte("test_meter\x00Energy"), nil); err != leveldb.ErrNotFound {
+		t.Errorf("outdated key kept: %v", err)
+	}
+}
+
+func TestPersistentMetricsForget(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pm := newPersistentMetrics(db)
+	for _, name := range []string{"test_old", "test_old_seconds"} {
+		if err := pm.putFloat64(name, []string{"cp1"}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pm.Forget("test_old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("test_old\x00cp1"), nil); err != leveldb.ErrNotFound {
+		t.Errorf("forgotten metric kept: %v", err)
+	}
+	if _, err := db.Get([]byte("test_old_seconds\x00cp1"), nil); err != nil {
+		t.Errorf("other metric gone: %v", err)
+	}
+}
+
+func TestPersistentMetricsUnlabelled(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pm := newPersistentMetrics(db)
+	// Stored while the metric had no labels.
+	if err := pm.putFloat64("test_heartbeat", nil, 1.7e12); err != nil {
+		t.Fatal(err)
+	}
+
+	gv := pm.NewGaugeVec(prometheus.GaugeOpts{Name: "test_heartbeat"}, []string{"chargepoint"})
+	t.Cleanup(func() { prometheus.Unregister(gv) })
+	if n := testutil.CollectAndCount(gv); n != 0 {
+		t.Errorf("loaded %d series, expected none", n)
+	}
+	if _, err := db.Get([]byte("test_heartbeat\x00"), nil); err != leveldb.ErrNotFound {
+		t.Errorf("unlabelled key kept: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	"github.com/gorilla/websocket"
+)
+
+// Proxy mode keeps the chargers connected to another CSMS, typically the
+// vendor's, with everything passing through us. We answer the chargers'
+// calls as usual to keep the metrics and transactions, and pass them on
+// upstream; the policy decides whose answer the charger gets. Our own calls
+// to the chargers are limited to the ones the policy allows.
+//
+// The charger knows its transactions by the IDs from whoever answered its
+// StartTransaction, so we note the upstream's ID as the ref of our
+// transaction and translate as messages pass. Transactions the upstream
+// started without us, say while we were down, aren't ours to account for.
+
+const (
+	proxyUpstreamWins = "upstream"
+	proxyLocalWins    = "local"
+)
+
+var upstream *proxyConfig // nil unless proxying
+
+type proxyConfig struct {
+	url     string
+	policy  string
+	inject  []string
+	timeout time.Duration // for the upstream's answers
+}
+
+// dial connects to the upstream as the charge point, with the credentials
+// and protocols the charger offered us.
+func (c *proxyConfig) dial(r *http.Request, id string) (*websocket.Conn, error) {
+	hdr := http.Header{}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		hdr.Set("Authorization", auth)
+	}
+	var protos []string
+	for _, p := range websocket.Subprotocols(r) {
+		if slices.Contains(upgrader.Subprotocols, p) {
+			protos = append(protos, p)
+		}
+	}
+	d := websocket.Dialer{Subprotocols: protos, HandshakeTimeout: writeTimeout}
+	conn, _, err := d.Dial(strings.TrimSuffix(c.url, "/")+"/"+url.PathEscape(id), hdr)
+	return conn, err
+}
+
+type proxy struct {
+	*proxyConfig
+	cp       *chargePoint
+	upstream *websocket.Conn
+	wmut     sync.Mutex
+
+	mut          sync.Mutex
+	fromCharger  map[string]*proxiedCall // awaiting the upstream's answer
+	fromUpstream map[string]bool         // awaiting the charger's answer
+}
+
+type proxiedCall struct {
+	res     any        // our answer, should the upstream not give one
+	callErr *callError // or our error
+	localTx int        // our ID for the transaction of a StartTransaction
+	later   []func()   // what to run once the charger has the answer
+}
+
+func newProxy(cfg *proxyConfig, cp *chargePoint, conn *websocket.Conn) *proxy {
+	return &proxy{
+		proxyConfig:  cfg,
+		cp:           cp,
+		upstream:     conn,
+		fromCharger:  make(map[string]*proxiedCall),
+		fromUpstream: make(map[string]bool),
+	}
+}
+
+// serve passes the upstream's messages on to the charger until either
+// goes away; the charger will reconnect and we with it.
+func (p *proxy) serve() {
+	defer p.cp.conn.Close()
+	for {
+		_, msg, err := p.upstream.ReadMessage()
+		if err != nil {
+			slog.Info("Upstream disconnected", "id", p.cp.ID, "err", err)
+			return
+		}
+		if err := p.handleUpstream(msg); err != nil {
+			slog.Info("Charge point disconnected", "id", p.cp.ID, "err", err)
+			return
+		}
+	}
+}
+
+func (p *proxy) handleUpstream(msg []byte) error {
+	var frame []json.RawMessage
+	var typ int
+	var uid string
+	if json.Unmarshal(msg, &frame) != nil || len(frame) < 3 || json.Unmarshal(frame[0], &typ) != nil || json.Unmarshal(frame[1], &uid) != nil {
+		slog.Error("Failed to parse upstream message", "id", p.cp.ID, "msg", string(msg))
+		return nil
+	}
+
+	if typ == messageCall {
+		if p.policy == proxyLocalWins && len(frame) == 4 {
+			// The charger has our transaction IDs, and none for the
+			// upstream's own transactions.
+			var known bool
+			if frame[3], known = p.rewrite(frame[3], p.toLocal); !known {
+				bs, _ := json.Marshal([]any{messageCallError, uid, "PropertyConstraintViolation", "unknown transaction", struct{}{}})
+				return p.writeUpstream(bs)
+			}
+			msg, _ = json.Marshal(frame)
+		}
+		p.mut.Lock()
+		p.fromUpstream[uid] = true
+		p.mut.Unlock()
+		return p.cp.writeMessage(msg)
+	}
+
+	p.mut.Lock()
+	pc, ok := p.fromCharger[uid]
+	delete(p.fromCharger, uid)
+	p.mut.Unlock()
+	if !ok {
+		slog.Warn("Upstream response to unknown call", "id", p.cp.ID, "uid", uid)
+		return nil
+	}
+	if typ == messageCallResult && pc.localTx != 0 {
+		var conf v16.StartTransactionConf
+		if err := json.Unmarshal(frame[2], &conf); err == nil && conf.TransactionId != 0 {
+			if err := transactions.SetRef(pc.localTx, strconv.Itoa(conf.TransactionId)); err != nil {
+				slog.Error("Failed to store upstream transaction ID", "id", p.cp.ID, "transaction", pc.localTx, "err", err)
+			}
+		}
+	}
+	if p.policy != proxyUpstreamWins {
+		return nil
+	}
+	err := p.cp.writeMessage(msg)
+	for _, fn := range pc.later {
+		go fn()
+	}
+	return err
+}
+
+// chargerCall handles a call from the charger, answering it ourselves or
+// leaving that to the upstream.
+func (p *proxy) chargerCall(uid, action string, payload json.RawMessage) error {
+	local, fwd := payload, payload
+	known := true
+	if p.policy == proxyLocalWins {
+		fwd, _ = p.rewrite(payload, p.toUpstream)
+	} else {
+		local, known = p.rewrite(payload, p.toLocal)
+	}
+	pc := &proxiedCall{}
+	if known {
+		pc.res, pc.callErr = p.cp.dispatch(action, local)
+	} else {
+		slog.Debug("Call for an upstream transaction, not recording it", "id", p.cp.ID, "action", action)
+		pc.callErr = &callError{Code: "InternalError", Description: "unknown transaction"}
+	}
+	if conf, ok := pc.res.(*v16.StartTransactionConf); ok {
+		pc.localTx = conf.TransactionId
+	}
+	if p.policy == proxyUpstreamWins {
+		pc.later, p.cp.later = p.cp.later, nil
+	}
+	p.mut.Lock()
+	p.fromCharger[uid] = pc
+	p.mut.Unlock()
+
+	bs, _ := json.Marshal([]any{messageCall, uid, action, fwd})
+	if err := p.writeUpstream(bs); err != nil {
+		slog.Warn("Failed to forward call upstream, answering locally", "id", p.cp.ID, "action", action, "err", err)
+		p.mut.Lock()
+		delete(p.fromCharger, uid)
+		p.mut.Unlock()
+		p.cp.later = append(p.cp.later, pc.later...)
+		return p.answer(uid, pc)
+	}
+	time.AfterFunc(p.timeout, func() { p.expire(uid, pc) })
+	if p.policy == proxyUpstreamWins {
+		return nil
+	}
+	return p.answer(uid, pc)
+}
+
+// expire gives up on the upstream's answer to the call, and answers the
+// charger ourselves if it's still waiting.
+func (p *proxy) expire(uid string, pc *proxiedCall) {
+	p.mut.Lock()
+	if p.fromCharger[uid] != pc {
+		// Answered.
+		p.mut.Unlock()
+		return
+	}
+	delete(p.fromCharger, uid)
+	p.mut.Unlock()
+	if p.policy != proxyUpstreamWins {
+		return
+	}
+
+	slog.Warn("No answer from upstream, answering locally", "id", p.cp.ID, "uid", uid)
+	if err := p.answer(uid, pc); err != nil {
+		slog.Debug("Failed to answer charger", "id", p.cp.ID, "err", err)
+	}
+	for _, fn := range pc.later {
+		go fn()
+	}
+}
+
+// answer gives the charger our answer to its call. Under the upstream-wins
+// policy that's only when the upstream can't, and then a transaction we
+// start is known to the charger by our own ID.
+func (p *proxy) answer(uid string, pc *proxiedCall) error {
+	if pc.localTx != 0 && p.policy == proxyUpstreamWins {
+		if err := transactions.SetRef(pc.localTx, strconv.Itoa(pc.localTx)); err != nil {
+			slog.Error("Failed to store transaction ID", "id", p.cp.ID, "transaction", pc.localTx, "err", err)
+		}
+	}
+	if pc.callErr != nil {
+		return p.cp.writeCallError(uid, pc.callErr)
+	}
+	return p.cp.write(messageCallResult, uid, pc.res)
+}
+
+// forwardResult passes the charger's answer to a call from the upstream
+// back, and returns whether it was one.
+func (p *proxy) forwardResult(uid string, msg []byte) bool {
+	p.mut.Lock()
+	ok := p.fromUpstream[uid]
+	delete(p.fromUpstream, uid)
+	p.mut.Unlock()
+	if !ok {
+		return false
+	}
+	if err := p.writeUpstream(msg); err != nil {
+		slog.Warn("Failed to forward response upstream", "id", p.cp.ID, "err", err)
+	}
+	return true
+}
+
+func (p *proxy) mayInject(action string) bool {
+	return slices.Contains(p.inject, action)
+}
+
+// outgoing prepares a call of ours for a charger that knows the upstream's
+// transaction IDs.
+func (p *proxy) outgoing(req any) (any, error) {
+	if p.policy != proxyUpstreamWins {
+		return req, nil
+	}
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	bs, _ = p.rewrite(bs, p.toUpstream)
+	return json.RawMessage(bs), nil
+}
+
+func (p *proxy) writeUpstream(bs []byte) error {
+	p.wmut.Lock()
+	defer p.wmut.Unlock()
+	_ = p.upstream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return p.upstream.WriteMessage(websocket.TextMessage, bs)
+}
+
+// toLocal maps the upstream's transaction ID to ours, if we have the
+// transaction.
+func (p *proxy) toLocal(id int) (int, bool) {
+	if t, ok := transactions.Find(p.cp.ID, strconv.Itoa(id)); ok {
+		return t.ID, true
+	}
+	return id, false
+}
+
+// toUpstream maps our transaction ID to the upstream's, if it has one.
+func (p *proxy) toUpstream(id int) (int, bool) {
+	if ref, ok := transactions.RefFor(id); ok {
+		if n, err := strconv.Atoi(ref); err == nil {
+			return n, true
+		}
+	}
+	return id, false
+}
+
+// rewrite returns the payload with the transaction IDs in it mapped by fn,
+// and whether fn could map them all. Unmapped IDs are left as they are.
+func (p *proxy) rewrite(payload json.RawMessage, fn func(int) (int, bool)) (json.RawMessage, bool) {
+	if !bytes.Contains(payload, []byte(`"transactionId"`)) {
+		return payload, true
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return payload, true
+	}
+	known := true
+	bs, err := json.Marshal(rewriteTransactionIDs(v, func(id int) int {
+		n, ok := fn(id)
+		known = known && ok
+		return n
+	}))
+	if err != nil {
+		return payload, true
+	}
+	return bs, known
+}
+
+func rewriteTransactionIDs(v any, fn func(int) int) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if n, ok := e.(json.Number); ok && k == "transactionId" {
+				if id, err := strconv.Atoi(n.String()); err == nil {
+					v[k] = fn(id)
+				}
+				continue
+			}
+			v[k] = rewriteTransactionIDs(e, fn)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = rewriteTransactionIDs(e, fn)
+		}
+	}
+	return v
+}
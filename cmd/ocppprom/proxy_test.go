@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubUpstream stands in for the vendor's CSMS, with its own transaction
+// IDs. It answers the charger's calls with answer, not at all if that
+// returns nil, and passes on everything else it gets.
+type stubUpstream struct {
+	url      string
+	received chan []json.RawMessage
+
+	mut  sync.Mutex
+	conn *websocket.Conn
+}
+
+func newStubUpstream(t *testing.T, protos []string, answer func(action string, payload json.RawMessage) any) *stubUpstream {
+	t.Helper()
+	s := &stubUpstream{received: make(chan []json.RawMessage, 16)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := websocket.Upgrader{Subprotocols: protos}
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.mut.Lock()
+		s.conn = conn
+		s.mut.Unlock()
+		for {
+			var frame []json.RawMessage
+			if err := conn.ReadJSON(&frame); err != nil {
+				return
+			}
+			if string(frame[0]) != "2" {
+				s.received <- frame
+				continue
+			}
+			var uid, action string
+			_ = json.Unmarshal(frame[1], &uid)
+			_ = json.Unmarshal(frame[2], &action)
+			if res := answer(action, frame[3]); res != nil {
+				s.send(messageCallResult, uid, res)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http") + "/ocpp/"
+	return s
+}
+
+func (s *stubUpstream) send(frame ...any) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	_ = s.conn.WriteJSON(frame)
+}
+
+// chargerCall makes the call as the charger and returns the answer,
+// declining any calls of ours on the way.
+func chargerCall(t *testing.T, conn *websocket.Conn, action, payload string) []json.RawMessage {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`[2,"1","`+action+`",`+payload+`]`)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var frame []json.RawMessage
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if string(frame[0]) != "2" {
+			return frame
+		}
+		// Our own calls, such as the TriggerMessage after boot.
+		_ = conn.WriteJSON([]any{messageCallResult, frame[1], map[string]any{"status": "Rejected"}})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	stub := newStubUpstream(t, []string{ocppV16}, func(action string, payload json.RawMessage) any {
+		switch action {
+		case "BootNotification":
+			return map[string]any{"status": "Accepted", "currentTime": "2024-01-01T00:00:00Z", "interval": 999}
+		case "StartTransaction":
+			return map[string]any{"transactionId": 777, "idTagInfo": map[string]any{"status": "Accepted"}}
+		case "MeterValues":
+			var mv struct{ TransactionId int }
+			_ = json.Unmarshal(payload, &mv)
+			if mv.TransactionId != 777 {
+				t.Errorf("upstream got transaction %d", mv.TransactionId)
+			}
+		}
+		return map[string]any{}
+	})
+	upstream = &proxyConfig{url: stub.url, policy: proxyUpstreamWins, inject: []string{"TriggerMessage"}, timeout: time.Minute}
+	defer func() { upstream = nil }()
+
+	conn := setupCSMS(t)("cp1", ocppV16)
+	call := func(action, payload string) string {
+		t.Helper()
+		return string(chargerCall(t, conn, action, payload)[2])
+	}
+
+	if res := call("BootNotification", `{"chargePointVendor":"v","chargePointModel":"m"}`); !strings.Contains(res, `"interval":999`) {
+		t.Errorf("charger got %s, not the upstream's answer", res)
+	}
+	if res := call("StartTransaction", `{"connectorId":1,"idTag":"tag1","meterStart":1000,"timestamp":"2024-01-01T00:00:00Z"}`); !strings.Contains(res, `"transactionId":777`) {
+		t.Errorf("charger got %s, not the upstream's transaction", res)
+	}
+	active := transactions.Active("cp1")
+	if len(active) != 1 || active[0].Ref != "777" {
+		t.Fatalf("expected a local transaction with ref 777, got %+v", active)
+	}
+	call("MeterValues", `{"connectorId":1,"transactionId":777,"meterValue":[{"timestamp":"2024-01-01T00:00:00Z","sampledValue":[{"value":"1500"}]}]}`)
+	if active := transactions.Active("cp1"); active[0].EnergyWh() != 500 {
+		t.Errorf("local transaction has %d Wh", active[0].EnergyWh())
+	}
+
+	// An upstream transaction that happens to share our transaction's
+	// number isn't ours.
+	local := strconv.Itoa(active[0].ID)
+	call("StopTransaction", `{"transactionId":`+local+`,"meterStop":2000,"timestamp":"2024-01-01T01:00:00Z"}`)
+	if active := transactions.Active("cp1"); len(active) != 1 {
+		t.Errorf("upstream transaction %s stopped ours", local)
+	}
+	call("StopTransaction", `{"transactionId":777,"meterStop":2000,"timestamp":"2024-01-01T01:00:00Z"}`)
+	if active := transactions.Active("cp1"); len(active) != 0 {
+		t.Errorf("transaction not stopped: %+v", active)
+	}
+
+	// The upstream's calls reach the charger, and its answers the upstream.
+	stub.send(messageCall, "u1", "GetConfiguration", map[string]any{})
+	var frame []json.RawMessage
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if string(frame[1]) != `"u1"` || string(frame[2]) != `"GetConfiguration"` {
+		t.Fatalf("charger got %s", frame)
+	}
+	_ = conn.WriteJSON([]any{messageCallResult, "u1", map[string]any{"configurationKey": []any{}}})
+	select {
+	case frame := <-stub.received:
+		if string(frame[0]) != "3" || string(frame[1]) != `"u1"` {
+			t.Errorf("upstream got %s", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer upstream")
+	}
+
+	// Calls the policy doesn't allow aren't made, nor counted.
+	cp, _ := chargePoints.Get("cp1")
+	series := testutil.CollectAndCount(chargerMessagesSent)
+	if err := cp.Call("Reset", map[string]any{"type": "Soft"}, nil); err != errNotAllowed {
+		t.Errorf("injected reset gave %v", err)
+	}
+	if n := testutil.CollectAndCount(chargerMessagesSent); n != series {
+		t.Errorf("refused call counted, %d series became %d", series, n)
+	}
+}
+
+func TestProxyLocalWins(t *testing.T) {
+	stub := newStubUpstream(t, []string{ocppV16}, func(action string, payload json.RawMessage) any {
+		if action == "StartTransaction" {
+			return map[string]any{"transactionId": 777, "idTagInfo": map[string]any{"status": "Accepted"}}
+		}
+		return map[string]any{}
+	})
+	upstream = &proxyConfig{url: stub.url, policy: proxyLocalWins, timeout: time.Minute}
+	defer func() { upstream = nil }()
+
+	conn := setupCSMS(t)("cp1", ocppV16)
+	res := chargerCall(t, conn, "StartTransaction", `{"connectorId":1,"idTag":"tag1","meterStart":1000,"timestamp":"2024-01-01T00:00:00Z"}`)
+	active := transactions.Active("cp1")
+	if len(active) != 1 || !strings.Contains(string(res[2]), `"transactionId":`+strconv.Itoa(active[0].ID)) {
+		t.Fatalf("charger got %s, not our transaction %+v", res[2], active)
+	}
+	select {
+	case frame := <-stub.received:
+		t.Fatalf("upstream got %s", frame)
+	default:
+	}
+
+	// Our transaction is known upstream by its ID there, once it's answered.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ref, _ := transactions.RefFor(active[0].ID); ref == "777" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upstream transaction ID not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stub.send(messageCall, "u1", "RemoteStopTransaction", map[string]any{"transactionId": 777})
+	var frame []json.RawMessage
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"transactionId":` + strconv.Itoa(active[0].ID) + `}`; string(frame[3]) != want {
+		t.Errorf("charger got %s, not %s", frame[3], want)
+	}
+	_ = conn.WriteJSON([]any{messageCallResult, "u1", map[string]any{"status": "Accepted"}})
+	<-stub.received
+
+	// The charger has no transactions the upstream started without us.
+	stub.send(messageCall, "u2", "RemoteStopTransaction", map[string]any{"transactionId": 555})
+	select {
+	case frame := <-stub.received:
+		if string(frame[0]) != "4" || string(frame[1]) != `"u2"` || string(frame[2]) != `"PropertyConstraintViolation"` {
+			t.Errorf("upstream got %s", frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer upstream")
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	stub := newStubUpstream(t, []string{ocppV16}, func(string, json.RawMessage) any { return nil })
+	upstream = &proxyConfig{url: stub.url, policy: proxyUpstreamWins, timeout: 50 * time.Millisecond}
+	defer func() { upstream = nil }()
+
+	conn := setupCSMS(t)("cp1", ocppV16)
+	res := chargerCall(t, conn, "StartTransaction", `{"connectorId":1,"idTag":"tag1","meterStart":1000,"timestamp":"2024-01-01T00:00:00Z"}`)
+	active := transactions.Active("cp1")
+	if len(active) != 1 || !strings.Contains(string(res[2]), `"transactionId":`+strconv.Itoa(active[0].ID)) {
+		t.Fatalf("charger got %s, not our transaction %+v", res[2], active)
+	}
+	if active[0].Ref != strconv.Itoa(active[0].ID) {
+		t.Errorf("transaction known to the charger as %q", active[0].Ref)
+	}
+}
+
+func TestProxySubprotocol(t *testing.T) {
+	stub := newStubUpstream(t, []string{ocppV201}, func(string, json.RawMessage) any { return map[string]any{} })
+	upstream = &proxyConfig{url: stub.url, policy: proxyUpstreamWins, timeout: time.Minute}
+	defer func() { upstream = nil }()
+
+	conn := setupCSMS(t)("cp1", ocppV16, ocppV201)
+	if p := conn.Subprotocol(); p != ocppV201 {
+		t.Errorf("charger got %q, not the upstream's choice", p)
+	}
+	if res := chargerCall(t, conn, "Heartbeat", `{}`); string(res[0]) != "3" {
+		t.Errorf("charger got %s", res)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	v16 "github.com/aliml92/ocpp/v16"
+)
+
+type chargePointStatus struct {
+	ID           string        `json:"id"`
+	Protocol     string        `json:"protocol"`
+	Transactions []transaction `json:"transactions"`
+}
+
+// handleListChargePoints lists the connected charge points with their
+// ongoing transactions, which is what a remote stop needs.
+func handleListChargePoints(w http.ResponseWriter, r *http.Request) {
+	res := []chargePointStatus{}
+	for _, cp := range chargePoints.Connected("") {
+		ts := transactions.Active(cp.ID)
+		if ts == nil {
+			ts = []transaction{}
+		}
+		res = append(res, chargePointStatus{ID: cp.ID, Protocol: cp.proto, Transactions: ts})
+	}
+	writeJSON(w, res)
+}
+
+// remoteCall returns a handler that sends the action to the charge point
+// in the path, with the request decoded from the body, and responds with
+// what the charge point said.
+func remoteCall[R any](action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req R
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := v16.Validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cp, ok := connectedV16(w, r)
+		if !ok {
+			return
+		}
+		id := cp.ID
+
+		slog.Info("Remote call", "id", id, "action", action, "req", req)
+		var res json.RawMessage
+		if err := cp.Call(action, req, &res); err != nil {
+			slog.Error("Remote call failed", "id", id, "action", action, "err", err)
+			writeCallError(w, err)
+			return
+		}
+		slog.Info("Remote call result", "id", id, "action", action, "res", string(res))
+		writeJSON(w, res)
+	}
+}
+
+// connectedV16 returns the charge point in the path, or responds with why
+// there is none we can control.
+func connectedV16(w http.ResponseWriter, r *http.Request) (*chargePoint, bool) {
+	cp, ok := chargePoints.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, errNotConnected.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if cp.proto != ocppV16 {
+		http.Error(w, "not supported for "+cp.proto, http.StatusNotImplemented)
+		return nil, false
+	}
+	return cp, true
+}
+
+func writeCallError(w http.ResponseWriter, err error) {
+	var callErr *callError
+	switch {
+	case errors.As(err, &callErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(callErr)
+	case errors.Is(err, errCallTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, errNotConnected):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNotAllowed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func addRemoteControl(api func(string, http.HandlerFunc)) {
+	api("GET /chargepoints", handleListChargePoints)
+	api("POST /chargepoints/{id}/start", remoteCall[v16.RemoteStartTransactionReq]("RemoteStartTransaction"))
+	api("POST /chargepoints/{id}/stop", remoteCall[v16.RemoteStopTransactionReq]("RemoteStopTransaction"))
+	api("POST /chargepoints/{id}/unlock", remoteCall[v16.UnlockConnectorReq]("UnlockConnector"))
+	api("POST /chargepoints/{id}/reset", remoteCall[v16.ResetReq]("Reset"))
+	api("POST /chargepoints/{id}/availability", remoteCall[v16.ChangeAvailabilityReq]("ChangeAvailability"))
+	api("POST /chargepoints/{id}/clear-cache", remoteCall[v16.ClearCacheReq]("ClearCache"))
+	api("POST /chargepoints/{id}/firmware", handleUpdateFirmware)
+	api("POST /chargepoints/{id}/diagnostics", handleGetDiagnostics)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"calmh.dev/homeprom/internal/ocppsim"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// checkSession asserts the metrics after the charging session of
+// TestSimulatedSession.
+func checkSession(t *testing.T, id string) {
+	t.Helper()
+	if v := testutil.ToFloat64(chargerState.WithLabelValues(id, "1")); v != 6 {
+		t.Errorf("%s: state %v, expected Finishing", id, v)
+	}
+	if v := testutil.ToFloat64(chargerSessions.WithLabelValues(id, "1")); v != 1 {
+		t.Errorf("%s: %v sessions", id, v)
+	}
+	if v := testutil.ToFloat64(chargerSessionEnergy.WithLabelValues(id, "1")); v != 3000 {
+		t.Errorf("%s: session energy %v Wh", id, v)
+	}
+	if v := testutil.ToFloat64(chargerMessagesReceived.WithLabelValues(id, "MeterValues", resultOK)); v != 2 {
+		t.Errorf("%s: %v meter values received", id, v)
+	}
+	expected := fmt.Sprintf(`
+# HELP charger_energy_active_import_wh_total
+# TYPE charger_energy_active_import_wh_total counter
+charger_energy_active_import_wh_total{chargepoint=%q,connector="1",location="Outlet",phase=""} 13000
+`, id)
+	if err := testutil.CollectAndCompare(meters, strings.NewReader(expected), "charger_energy_active_import_wh_total"); err != nil {
+		t.Errorf("%s: %v", id, err)
+	}
+}
+
+func TestSimulatedSession(t *testing.T) {
+	for _, id := range []string{"sim1", "sim2"} {
+		chargerSessions.DeletePartialMatch(prometheus.Labels{"chargepoint": id})
+		chargerMessagesReceived.DeletePartialMatch(prometheus.Labels{"chargepoint": id})
+	}
+	var log bytes.Buffer
+	frameLog = newFrameLogger(&log)
+	defer func() { frameLog = nil }()
+
+	cp := ocppsim.New(setupCSMS(t)("sim1", ocppV16))
+	if status, err := cp.Boot("Vendor", "Model"); err != nil || status != "Accepted" {
+		t.Fatalf("boot: %q, %v", status, err)
+	}
+	if err := cp.Status(1, "Preparing"); err != nil {
+		t.Fatal(err)
+	}
+	tx, _, err := cp.StartTransaction(1, "tag1", 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{
+		func() error { return cp.Status(1, "Charging") },
+		func() error { return cp.MeterValues(1, tx, 11500, 7400) },
+		func() error { return cp.MeterValues(1, tx, 13000, 7400) },
+		func() error { return cp.StopTransaction(tx, 13000, "EVDisconnected") },
+		func() error { return cp.Status(1, "Finishing") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSession(t, "sim1")
+	cp.Close()
+	frameLog = nil
+
+	if !strings.Contains(log.String(), `"direction":"out","frame":[3,`) {
+		t.Errorf("responses not logged:\n%s", log.String())
+	}
+
+	// The same session from the log, as another charger against a fresh
+	// central system.
+	cp = ocppsim.New(setupCSMS(t)("sim2", ocppV16))
+	defer cp.Close()
+	if err := cp.Replay(&log, "sim1"); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, "sim2")
+}
+
+func TestReplayLog(t *testing.T) {
+	chargerSessions.DeletePartialMatch(prometheus.Labels{"chargepoint": "sim3"})
+	chargerMessagesReceived.DeletePartialMatch(prometheus.Labels{"chargepoint": "sim3"})
+	f, err := os.Open("testdata/session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// A session from last year, replayed where its transaction ID is
+	// another charger's.
+	dial := setupCSMS(t)
+	other, err := transactions.Start("cp1", 1, "tag0", 500, time.Now(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := ocppsim.New(dial("sim3", ocppV16))
+	defer cp.Close()
+	if err := cp.Replay(f, "sim1"); err != nil {
+		t.Fatal(err)
+	}
+	checkSession(t, "sim3")
+	if active := transactions.Active("cp1"); len(active) != 1 || active[0].ID != other.ID || active[0].MeterLast != 500 {
+		t.Errorf("replay touched transaction %d: %+v", other.ID, active)
+	}
+	// The session, 24 minutes in the log, took no time at all.
+	recent, err := transactions.Recent(1, "sim3")
+	if err != nil || len(recent) != 1 || recent[0].Stopped == nil {
+		t.Fatalf("replayed transaction: %+v, %v", recent, err)
+	}
+	now := time.Now()
+	if started, stopped := recent[0].Started, *recent[0].Stopped; now.Sub(started) > time.Minute || stopped.After(now) {
+		t.Errorf("replayed transaction from %v to %v, at %v", started, stopped, now)
+	}
+}
+
+func TestInvalidCall(t *testing.T) {
+	cp := ocppsim.New(setupCSMS(t)("cp1", ocppV16))
+	defer cp.Close()
+	err := cp.Call("StatusNotification", map[string]any{"connectorId": 1, "errorCode": "NoError", "status": "Sleeping"}, nil)
+	var callErr *ocppsim.CallError
+	if !errors.As(err, &callErr) || callErr.Code != "PropertyConstraintViolation" {
+		t.Fatalf("invalid status: %v", err)
+	}
+	if n := testutil.CollectAndCount(chargerState); n != 0 {
+		t.Errorf("invalid status recorded")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	cp := ocppsim.New(setupCSMS(t)("cp1", ocppV16))
+	defer cp.Close()
+	if err := cp.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	got := testutil.ToFloat64(chargerLastHeartbeat.WithLabelValues("cp1"))
+	if now := float64(time.Now().Unix()); got < now-60 || got > now+1 {
+		t.Errorf("last heartbeat %v, expected about %v", got, now)
+	}
+}
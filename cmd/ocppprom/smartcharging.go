@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Charging profile IDs; a profile replaces an earlier one with the same
+// ID, so each purpose and connector has its own.
+const (
+	defaultProfileID = 1
+	txProfileIDBase  = 100
+)
+
+var (
+	chargerCurrentLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_current_limit_amperes",
+	}, []string{"chargepoint"})
+	chargerHeadroom = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "charger_headroom_amperes",
+	})
+)
+
+// The library's charging profile types have the schedule period start as
+// a string, which chargers reject, so we use our own.
+
+type setChargingProfileReq struct {
+	ConnectorId        int             `json:"connectorId"`
+	CsChargingProfiles chargingProfile `json:"csChargingProfiles"`
+}
+
+type chargingProfile struct {
+	ChargingProfileId      int              `json:"chargingProfileId"`
+	TransactionId          int              `json:"transactionId,omitempty"`
+	StackLevel             int              `json:"stackLevel"`
+	ChargingProfilePurpose string           `json:"chargingProfilePurpose"`
+	ChargingProfileKind    string           `json:"chargingProfileKind"`
+	ChargingSchedule       chargingSchedule `json:"chargingSchedule"`
+}
+
+type chargingSchedule struct {
+	ChargingRateUnit       string                   `json:"chargingRateUnit"`
+	ChargingSchedulePeriod []chargingSchedulePeriod `json:"chargingSchedulePeriod"`
+}
+
+type chargingSchedulePeriod struct {
+	StartPeriod int     `json:"startPeriod"`
+	Limit       float64 `json:"limit"`
+}
+
+// smartCharging limits the charging current of the connected chargers to
+// what the schedule allows and what's left on the main fuse.
+type smartCharging struct {
+	maxCurrent float64
+	minCurrent float64
+	margin     float64
+	schedule   []scheduleEntry
+	headroom   *headroomSignal // nil without a headroom source
+	interval   time.Duration
+
+	mut      sync.Mutex
+	measured map[string]reading // charger current, highest phase
+	sent     map[string]float64 // last limit sent
+	caps     map[string]float64 // limits set by hand
+}
+
+type reading struct {
+	val  float64
+	when time.Time
+}
+
+func newSmartCharging(cli *CLI) (*smartCharging, error) {
+	schedule, err := parseSchedule(cli.CurrentSchedule)
+	if err != nil {
+		return nil, err
+	}
+	s := &smartCharging{
+		maxCurrent: cli.MaxCurrent,
+		minCurrent: cli.MinCurrent,
+		margin:     cli.HeadroomMargin,
+		schedule:   schedule,
+		interval:   cli.ProfileInterval,
+		measured:   make(map[string]reading),
+		sent:       make(map[string]float64),
+		caps:       make(map[string]float64),
+	}
+	if cli.HeadroomTopic != "" || cli.HeadroomURL != "" {
+		s.headroom = &headroomSignal{maxAge: 3 * cli.ProfileInterval}
+	}
+	return s, nil
+}
+
+// Serve recomputes the limit every interval and sends it to the chargers
+// for which it changed.
+func (s *smartCharging) Serve(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			limit := s.limit(time.Now())
+			for _, cp := range chargePoints.Connected(ocppV16) {
+				cpLimit := s.capped(cp.ID, limit)
+				s.mut.Lock()
+				sent, ok := s.sent[cp.ID]
+				s.mut.Unlock()
+				if !ok || math.Abs(sent-cpLimit) >= 0.1 {
+					s.apply(cp, cpLimit)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ObserveCurrent records a measured charging current for a charger.
+func (s *smartCharging) ObserveCurrent(chargePoint string, amperes float64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	now := time.Now()
+	if r, ok := s.measured[chargePoint]; ok && now.Sub(r.when) < time.Second {
+		// Another phase of the same sample.
+		amperes = max(amperes, r.val)
+	}
+	s.measured[chargePoint] = reading{amperes, now}
+}
+
+// SetCap limits the charger's current further than the schedule and the
+// headroom do, and sends the new limit.
+func (s *smartCharging) SetCap(cp *chargePoint, amperes float64) {
+	s.mut.Lock()
+	s.caps[cp.ID] = amperes
+	s.mut.Unlock()
+	s.apply(cp, s.capped(cp.ID, s.limit(time.Now())))
+}
+
+// capped returns the limit for the charger, lowered to its cap if it has
+// one.
+func (s *smartCharging) capped(chargePoint string, limit float64) float64 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if c, ok := s.caps[chargePoint]; ok {
+		return min(limit, c)
+	}
+	return limit
+}
+
+// limit returns the current each charger may use. The headroom is what's
+// left on the fuse with the chargers drawing what they do, so that's
+// shared among the chargers that are charging.
+func (s *smartCharging) limit(now time.Time) float64 {
+	limit := s.scheduleLimit(now)
+	if s.headroom != nil {
+		if headroom, ok := s.headroom.Get(now); ok {
+			chargerHeadroom.Set(headroom)
+			draw, charging := s.draw(now)
+			limit = min(limit, (draw+headroom-s.margin)/float64(max(charging, 1)))
+		} else {
+			slog.Warn("No current headroom value, charging at most at minimum")
+			limit = min(limit, s.minCurrent)
+		}
+	}
+	if limit < s.minCurrent {
+		return 0
+	}
+	return math.Floor(min(limit, s.maxCurrent)*10) / 10
+}
+
+// draw returns the total current of the chargers with an active
+// transaction, taking the limit we gave a charger as its draw when we
+// haven't heard from it lately.
+func (s *smartCharging) draw(now time.Time) (float64, int) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var total float64
+	charging := 0
+	for _, cp := range chargePoints.Connected(ocppV16) {
+		if len(transactions.Active(cp.ID)) == 0 {
+			continue
+		}
+		charging++
+		if r, ok := s.measured[cp.ID]; ok && now.Sub(r.when) < 2*s.interval {
+			total += r.val
+		} else {
+			total += s.sent[cp.ID]
+		}
+	}
+	return total, charging
+}
+
+func (s *smartCharging) scheduleLimit(now time.Time) float64 {
+	for _, e := range s.schedule {
+		if e.contains(now) {
+			return e.limit
+		}
+	}
+	return s.maxCurrent
+}
+
+// apply sends the limit to the charger and remembers it as sent, unless
+// the charger is proxied and we may not.
+func (s *smartCharging) apply(cp *chargePoint, limit float64) {
+	if !cp.mayCall("SetChargingProfile") {
+		return
+	}
+	if err := sendCurrentLimit(cp, limit); err != nil {
+		slog.Error("Failed to set charging profile", "id", cp.ID, "err", err)
+		return
+	}
+	s.mut.Lock()
+	s.sent[cp.ID] = limit
+	s.mut.Unlock()
+}
+
+// sendCurrentLimit sends the limit as the default profile for new
+// transactions, and as a transaction profile for the ongoing ones.
+func sendCurrentLimit(cp *chargePoint, limit float64) error {
+	reqs := []setChargingProfileReq{{
+		ConnectorId: 0,
+		CsChargingProfiles: chargingProfile{
+			ChargingProfileId:      defaultProfileID,
+			ChargingProfilePurpose: "TxDefaultProfile",
+			ChargingProfileKind:    "Relative",
+			ChargingSchedule:       ampereSchedule(limit),
+		},
+	}}
+	for _, t := range transactions.Active(cp.ID) {
+		reqs = append(reqs, setChargingProfileReq{
+			ConnectorId: t.Connector,
+			CsChargingProfiles: chargingProfile{
+				ChargingProfileId:      txProfileIDBase + t.Connector,
+				TransactionId:          t.ID,
+				ChargingProfilePurpose: "TxProfile",
+				ChargingProfileKind:    "Relative",
+				ChargingSchedule:       ampereSchedule(limit),
+			},
+		})
+	}
+
+	for _, req := range reqs {
+		var conf v16.SetChargingProfileConf
+		if err := cp.Call("SetChargingProfile", req, &conf); err != nil {
+			return fmt.Errorf("connector %d: %w", req.ConnectorId, err)
+		}
+		if conf.Status != "Accepted" {
+			return fmt.Errorf("connector %d: %s", req.ConnectorId, conf.Status)
+		}
+	}
+
+	slog.Info("Set current limit", "id", cp.ID, "limit", limit)
+	chargerCurrentLimit.WithLabelValues(cp.ID).Set(limit)
+	if ha != nil {
+		ha.CurrentLimit(cp.ID, limit)
+	}
+	return nil
+}
+
+func ampereSchedule(limit float64) chargingSchedule {
+	return chargingSchedule{
+		ChargingRateUnit:       "A",
+		ChargingSchedulePeriod: []chargingSchedulePeriod{{StartPeriod: 0, Limit: limit}},
+	}
+}
+
+// headroomSignal is the most recent headroom value, from wherever it
+// comes from.
+type headroomSignal struct {
+	maxAge time.Duration
+
+	mut  sync.Mutex
+	val  float64
+	when time.Time
+}
+
+func (h *headroomSignal) Set(val float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.val = val
+	h.when = time.Now()
+}
+
+// Get returns the value, if it's recent enough to act on.
+func (h *headroomSignal) Get(now time.Time) (float64, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.when.IsZero() || now.Sub(h.when) > h.maxAge {
+		return 0, false
+	}
+	return h.val, true
+}
+
+// Subscribe sets the headroom from the values published on the topic.
+func (h *headroomSignal) Subscribe(opts *mqtt.ClientOptions, topic string) error {
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		val, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+		if err != nil {
+			slog.Error("Failed to parse headroom", "topic", topic, "payload", string(msg.Payload()), "err", err)
+			return
+		}
+		h.Set(val)
+	}
+	// Subscribe again on every reconnect, as the session may be gone.
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		if token := c.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
+			slog.Error("Failed to subscribe", "topic", topic, "err", token.Error())
+		}
+	})
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("connect to MQTT: %w", token.Error())
+	}
+	return nil
+}
+
+// Poll sets the headroom from the URL every interval.
+func (h *headroomSignal) Poll(ctx context.Context, url string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		val, err := fetchHeadroom(client, url)
+		if err != nil {
+			slog.Error("Failed to fetch headroom", "url", url, "err", err)
+		} else {
+			h.Set(val)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func fetchHeadroom(client *http.Client, url string) (float64, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(bs)), 64)
+}
+
+// scheduleEntry is a current limit for a time of day, which may span
+// midnight.
+type scheduleEntry struct {
+	from, to time.Duration // since midnight
+	limit    float64
+}
+
+func (e scheduleEntry) contains(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if e.from <= e.to {
+		return tod >= e.from && tod < e.to
+	}
+	return tod >= e.from || tod < e.to
+}
+
+// parseSchedule parses "HH:MM-HH:MM=A,..." into schedule entries.
+func parseSchedule(s string) ([]scheduleEntry, error) {
+	var entries []scheduleEntry
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		span, limitStr, ok := strings.Cut(part, "=")
+		fromStr, toStr, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("schedule entry %q: expected HH:MM-HH:MM=A", part)
+		}
+		from, err := parseTimeOfDay(fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %q: %w", part, err)
+		}
+		to, err := parseTimeOfDay(toStr)
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %q: %w", part, err)
+		}
+		limit, err := strconv.ParseFloat(limitStr, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("schedule entry %q: bad limit", part)
+		}
+		entries = append(entries, scheduleEntry{from, to, limit})
+	}
+	return entries, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
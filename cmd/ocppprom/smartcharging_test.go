@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSmartChargingLimit(t *testing.T) {
+	// No chargers are connected, so the draw is zero.
+	oldChargePoints := chargePoints
+	chargePoints = &registry{cps: make(map[string]*chargePoint)}
+	t.Cleanup(func() { chargePoints = oldChargePoints })
+
+	schedule, err := parseSchedule("06:00-06:30=0, 22:00-06:00=16, 06:00-22:00=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smartCharging{
+		maxCurrent: 20,
+		minCurrent: 6,
+		margin:     1,
+		schedule:   schedule,
+		interval:   time.Minute,
+		headroom:   &headroomSignal{maxAge: time.Minute},
+	}
+
+	night := time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local)
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	morning := time.Date(2024, 1, 2, 6, 15, 0, 0, time.Local)
+	setHeadroom := func(val float64, when time.Time) {
+		s.headroom.val, s.headroom.when = val, when
+	}
+
+	cases := []struct {
+		headroom float64
+		at       time.Time
+		set      time.Time
+		want     float64
+	}{
+		{30, night, night, 16},                // schedule
+		{30, day, day, 10},                    // schedule
+		{30, night, night.Add(-time.Hour), 6}, // stale headroom
+		{8.55, night, night, 7.5},             // headroom less margin
+		{5, day, day, 0},                      // too little to charge
+		{30, morning, night, 0},               // stale headroom, schedule off
+	}
+	for _, tc := range cases {
+		setHeadroom(tc.headroom, tc.set)
+		if got := s.limit(tc.at); got != tc.want {
+			t.Errorf("headroom %v at %v: limit %v, expected %v", tc.headroom, tc.at.Format(time.TimeOnly), got, tc.want)
+		}
+	}
+
+	if _, err := parseSchedule("22:00=16"); err == nil {
+		t.Error("accepted schedule without end time")
+	}
+}
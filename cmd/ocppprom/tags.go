@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	v16 "github.com/aliml92/ocpp/v16"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	tagPrefix      = "idtag\x00"
+	tagVersionKey  = "idtag-version"
+	maxIDTagLength = 20
+)
+
+var chargerAuthorizationsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "charger_authorizations_rejected_total",
+}, []string{"chargepoint", "status"})
+
+var errUnknownTag = errors.New("unknown idTag")
+
+var tagStatuses = []string{"Accepted", "Blocked", "Expired"}
+
+// idTag is an entry in the authorization list.
+type idTag struct {
+	IDTag       string     `json:"idTag"`
+	Status      string     `json:"status"`
+	ExpiryDate  *time.Time `json:"expiryDate,omitempty"`
+	ParentIDTag string     `json:"parentIdTag,omitempty"`
+}
+
+func (t *idTag) validate() error {
+	if t.IDTag == "" || len(t.IDTag) > maxIDTagLength {
+		return fmt.Errorf("idTag must be 1 to %d characters", maxIDTagLength)
+	}
+	if len(t.ParentIDTag) > maxIDTagLength {
+		return fmt.Errorf("parentIdTag must be at most %d characters", maxIDTagLength)
+	}
+	if !slices.Contains(tagStatuses, t.Status) {
+		return fmt.Errorf("status must be one of %v", tagStatuses)
+	}
+	return nil
+}
+
+// info returns the tag info to send to a charger, with accepted tags past
+// their expiry date as expired.
+func (t *idTag) info(now time.Time) v16.IdTagInfo {
+	info := v16.IdTagInfo{
+		Status:      t.Status,
+		ParentIdTag: t.ParentIDTag,
+	}
+	if t.ExpiryDate != nil {
+		info.ExpiryDate = t.ExpiryDate.UTC().Format(time.RFC3339)
+		if info.Status == "Accepted" && now.After(*t.ExpiryDate) {
+			info.Status = "Expired"
+		}
+	}
+	return info
+}
+
+// tagStore keeps the authorization list in the database, with a version
+// number that increases on every change for the chargers' local lists.
+type tagStore struct {
+	db  *leveldb.DB
+	mut sync.Mutex
+}
+
+func newTagStore(db *leveldb.DB) *tagStore {
+	return &tagStore{db: db}
+}
+
+// Authorize returns the tag info for id, which is "Invalid" for tags we
+// don't know. Anything not accepted is counted.
+func (s *tagStore) Authorize(chargePoint, id string) v16.IdTagInfo {
+	info := v16.IdTagInfo{Status: "Invalid"}
+	t, err := s.Get(id)
+	switch {
+	case err == nil:
+		info = t.info(time.Now())
+	case !errors.Is(err, errUnknownTag):
+		slog.Error("Failed to look up idTag", "id", chargePoint, "idTag", id, "err", err)
+	}
+	if info.Status != "Accepted" {
+		slog.Info("Rejected idTag", "id", chargePoint, "idTag", id, "status", info.Status)
+		chargerAuthorizationsRejected.WithLabelValues(chargePoint, info.Status).Inc()
+	}
+	return info
+}
+
+func (s *tagStore) Get(id string) (*idTag, error) {
+	bs, err := s.db.Get([]byte(tagPrefix+id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, errUnknownTag
+	} else if err != nil {
+		return nil, err
+	}
+	var t idTag
+	if err := json.Unmarshal(bs, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *tagStore) List() ([]idTag, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.listLocked()
+}
+
+func (s *tagStore) listLocked() ([]idTag, error) {
+	it := s.db.NewIterator(util.BytesPrefix([]byte(tagPrefix)), nil)
+	defer it.Release()
+	tags := []idTag{}
+	for it.Next() {
+		var t idTag
+		if err := json.Unmarshal(it.Value(), &t); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, it.Error()
+}
+
+// Put adds or replaces a tag.
+func (s *tagStore) Put(t idTag) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(tagPrefix+t.IDTag), bs)
+	return s.commitLocked(batch)
+}
+
+func (s *tagStore) Delete(id string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(tagPrefix + id))
+	return s.commitLocked(batch)
+}
+
+// commitLocked writes batch along with the next list version.
+func (s *tagStore) commitLocked(batch *leveldb.Batch) error {
+	version, err := s.versionLocked()
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(tagVersionKey), binary.BigEndian.AppendUint64(nil, uint64(version+1)))
+	return s.db.Write(batch, nil)
+}
+
+func (s *tagStore) versionLocked() (int, error) {
+	bs, err := s.db.Get([]byte(tagVersionKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint64(bs)), nil
+}
+
+// LocalList returns the list as sent to chargers, and its version.
+func (s *tagStore) LocalList() (int, []v16.AuthorizationData, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	version, err := s.versionLocked()
+	if err != nil {
+		return 0, nil, err
+	}
+	tags, err := s.listLocked()
+	if err != nil {
+		return 0, nil, err
+	}
+	now := time.Now()
+	list := make([]v16.AuthorizationData, len(tags))
+	for i, t := range tags {
+		list[i] = v16.AuthorizationData{IdTag: t.IDTag, IdTagInfo: t.info(now)}
+	}
+	return version, list, nil
+}
+
+// syncLocalList sends the authorization list to the charger, unless it
+// already has the current version or we may not.
+func syncLocalList(cp *chargePoint) {
+	if !cp.mayCall("GetLocalListVersion") || !cp.mayCall("SendLocalList") {
+		return
+	}
+	version, list, err := tags.LocalList()
+	if err != nil {
+		slog.Error("Failed to load local list", "id", cp.ID, "err", err)
+		return
+	}
+
+	var conf v16.GetLocalListVersionConf
+	if err := cp.Call("GetLocalListVersion", v16.GetLocalListVersionReq{}, &conf); err != nil {
+		slog.Error("Failed to get local list version", "id", cp.ID, "err", err)
+		return
+	}
+	if conf.ListVersion < 0 {
+		slog.Debug("Local list not supported", "id", cp.ID)
+		return
+	}
+	if conf.ListVersion == version {
+		slog.Debug("Local list up to date", "id", cp.ID, "version", version)
+		return
+	}
+
+	var sendConf v16.SendLocalListConf
+	err = cp.Call("SendLocalList", v16.SendLocalListReq{
+		ListVersion:            &version,
+		LocalAuthorizationList: list,
+		UpdateType:             "Full",
+	}, &sendConf)
+	if err != nil {
+		slog.Error("Failed to send local list", "id", cp.ID, "err", err)
+		return
+	}
+	if sendConf.Status != "Accepted" {
+		slog.Error("Failed to send local list", "id", cp.ID, "status", sendConf.Status)
+	} else {
+		slog.Info("Sent local list", "id", cp.ID, "version", version, "tags", len(list))
+	}
+}
+
+// pushLocalList sends the current authorization list to all connected OCPP
+// 1.6 charge points.
+func pushLocalList() {
+	for _, cp := range chargePoints.Connected(ocppV16) {
+		syncLocalList(cp)
+	}
+}
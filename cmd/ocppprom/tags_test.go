@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTagStore(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := newTagStore(db)
+
+	past := time.Now().Add(-time.Hour)
+	for _, tag := range []idTag{
+		{IDTag: "good", Status: "Accepted"},
+		{IDTag: "old", Status: "Accepted", ExpiryDate: &past},
+		{IDTag: "bad", Status: "Blocked"},
+	} {
+		if err := s.Put(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(idTag{IDTag: "weird", Status: "Maybe"}); err == nil {
+		t.Error("accepted invalid status")
+	}
+
+	for id, want := range map[string]string{"good": "Accepted", "old": "Expired", "bad": "Blocked", "unknown": "Invalid"} {
+		if got := s.Authorize("cp", id).Status; got != want {
+			t.Errorf("%s: status %s, expected %s", id, got, want)
+		}
+	}
+
+	if err := s.Delete("bad"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("bad"); err != errUnknownTag {
+		t.Errorf("deleting unknown tag: %v", err)
+	}
+	version, list, err := s.LocalList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 4 || len(list) != 2 {
+		t.Errorf("version %d with %d tags, expected 4 with 2", version, len(list))
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Transactions are stored under this prefix followed by the big endian
+// transaction ID, so that they iterate in order.
+const transactionPrefix = "transaction\x00"
+
+// How many stored transactions of a charge point to look through when a
+// charger refers to one that is no longer ongoing.
+const findRecentLimit = 20
+
+var (
+	chargerSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "charger_sessions_total",
+	}, []string{"chargepoint", "connector"})
+	chargerSessionEnergy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "charger_session_energy_wh",
+	}, []string{"chargepoint", "connector"})
+)
+
+var (
+	errUnknownTransaction = errors.New("unknown transaction")
+	errOtherChargePoint   = errors.New("transaction of another charge point")
+)
+
+type transaction struct {
+	ID          int        `json:"id"`
+	ChargePoint string     `json:"chargePoint"`
+	Connector   int        `json:"connector"`
+	IDTag       string     `json:"idTag"`
+	MeterStart  int        `json:"meterStartWh"`
+	MeterLast   int        `json:"meterLastWh"`
+	MeterStop   *int       `json:"meterStopWh,omitempty"`
+	Started     time.Time  `json:"started"`
+	Stopped     *time.Time `json:"stopped,omitempty"`
+	StopReason  string     `json:"stopReason,omitempty"`
+	// Ref is the transaction ID assigned by an OCPP 2.0.1 charger, or by
+	// the upstream CSMS when proxying.
+	Ref string `json:"ref,omitempty"`
+}
+
+// EnergyWh returns the energy delivered so far, or in total when the
+// transaction has stopped.
+func (t *transaction) EnergyWh() int {
+	if t.MeterStop != nil {
+		return *t.MeterStop - t.MeterStart
+	}
+	return t.MeterLast - t.MeterStart
+}
+
+func (t *transaction) labels() []string {
+	return []string{t.ChargePoint, strconv.Itoa(t.Connector)}
+}
+
+// transactionStore keeps transaction records in the database and the
+// ongoing ones in memory.
+type transactionStore struct {
+	db *leveldb.DB
+
+	mut    sync.Mutex
+	nextID int
+	active map[int]*transaction
+}
+
+func newTransactionStore(db *leveldb.DB) (*transactionStore, error) {
+	s := &transactionStore{
+		db:     db,
+		nextID: 1,
+		active: make(map[int]*transaction),
+	}
+
+	it := db.NewIterator(util.BytesPrefix([]byte(transactionPrefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		var t transaction
+		if err := json.Unmarshal(it.Value(), &t); err != nil {
+			return nil, fmt.Errorf("transaction %x: %w", it.Key(), err)
+		}
+		s.nextID = t.ID + 1
+		if t.Stopped == nil {
+			s.active[t.ID] = &t
+		} else {
+			chargerSessions.WithLabelValues(t.labels()...).Inc()
+		}
+		chargerSessionEnergy.WithLabelValues(t.labels()...).Set(float64(t.EnergyWh()))
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Start records a new transaction and returns it with its assigned ID. The
+// ref is the charger's own ID for the transaction, if it has one.
+func (s *transactionStore) Start(chargePoint string, connector int, idTag string, meterStart int, started time.Time, ref string) (*transaction, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, old := range s.active {
+		if old.ChargePoint == chargePoint && old.Connector == connector {
+			// The charger can't have two transactions on a connector, so
+			// we missed the end of this one.
+			slog.Warn("Closing stale transaction", "id", chargePoint, "connector", connector, "transaction", old.ID)
+			if err := s.stopLocked(old, old.MeterLast, started, "Other"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	t := &transaction{
+		ID:          s.nextID,
+		ChargePoint: chargePoint,
+		Connector:   connector,
+		IDTag:       idTag,
+		MeterStart:  meterStart,
+		MeterLast:   meterStart,
+		Started:     started,
+		Ref:         ref,
+	}
+	if err := s.put(t); err != nil {
+		return nil, err
+	}
+	s.nextID++
+	s.active[t.ID] = t
+	chargerSessionEnergy.WithLabelValues(t.labels()...).Set(0)
+	if ha != nil {
+		ha.Session(t)
+	}
+	return t, nil
+}
+
+// ReserveID returns a transaction ID for a transaction we failed to store,
+// so that the charger still gets one from our sequence.
+func (s *transactionStore) ReserveID() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+// Update records a meter reading taken during the transaction. The
+// register only counts up, so a lower reading is an older one sent late
+// and is ignored.
+func (s *transactionStore) Update(id, meterWh int) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	t, ok := s.active[id]
+	if !ok {
+		return errUnknownTransaction
+	}
+	if meterWh <= t.MeterLast {
+		return nil
+	}
+	t.MeterLast = meterWh
+	chargerSessionEnergy.WithLabelValues(t.labels()...).Set(float64(t.EnergyWh()))
+	if ha != nil {
+		ha.Session(t)
+	}
+	return s.put(t)
+}
+
+// Stop completes the transaction. Chargers resend stops they aren't sure
+// were received, so stopping a stopped transaction is not an error. A
+// transaction we don't know at all, like one started while we were not
+// reachable, is recorded as well, with what little we know about it. A
+// transaction of another charge point is not stopped.
+func (s *transactionStore) Stop(chargePoint string, id, meterStop int, stopped time.Time, reason string) (*transaction, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	t, ok := s.active[id]
+	if ok && t.ChargePoint != chargePoint {
+		return nil, errOtherChargePoint
+	}
+	if !ok {
+		old, err := s.get(id)
+		switch {
+		case err == nil && old.ChargePoint != chargePoint:
+			return nil, errOtherChargePoint
+		case err == nil && old.Stopped != nil:
+			return old, nil
+		case err != nil && !errors.Is(err, leveldb.ErrNotFound):
+			return nil, err
+		}
+		slog.Warn("Stopping unknown transaction", "id", chargePoint, "transaction", id)
+		t = &transaction{
+			ID:          id,
+			ChargePoint: chargePoint,
+			MeterStart:  meterStop,
+			Started:     stopped,
+		}
+		s.nextID = max(s.nextID, id+1)
+	}
+	if err := s.stopLocked(t, meterStop, stopped, reason); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *transactionStore) stopLocked(t *transaction, meterStop int, stopped time.Time, reason string) error {
+	t.MeterLast = meterStop
+	t.MeterStop = &meterStop
+	t.Stopped = &stopped
+	t.StopReason = reason
+	if err := s.put(t); err != nil {
+		return err
+	}
+	delete(s.active, t.ID)
+	chargerSessions.WithLabelValues(t.labels()...).Inc()
+	chargerSessionEnergy.WithLabelValues(t.labels()...).Set(float64(t.EnergyWh()))
+	if ha != nil {
+		ha.Session(t)
+	}
+	return nil
+}
+
+// Active returns the ongoing transactions of the charge point.
+func (s *transactionStore) Active(chargePoint string) []transaction {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var res []transaction
+	for _, t := range s.active {
+		if t.ChargePoint == chargePoint {
+			res = append(res, *t)
+		}
+	}
+	return res
+}
+
+// Find returns the transaction of the charge point with the given charger
+// assigned ID, looking among the ongoing ones and the most recent stored.
+func (s *transactionStore) Find(chargePoint, ref string) (transaction, bool) {
+	s.mut.Lock()
+	for _, t := range s.active {
+		if t.ChargePoint == chargePoint && t.Ref == ref {
+			s.mut.Unlock()
+			return *t, true
+		}
+	}
+	s.mut.Unlock()
+
+	recent, err := s.Recent(findRecentLimit, chargePoint)
+	if err != nil {
+		slog.Error("Failed to load transactions", "err", err)
+		return transaction{}, false
+	}
+	for _, t := range recent {
+		if t.Ref == ref {
+			return t, true
+		}
+	}
+	return transaction{}, false
+}
+
+// Recent returns up to limit of the latest transactions, newest first,
+// optionally only those of the given charge point.
+func (s *transactionStore) Recent(limit int, chargePoint string) ([]transaction, error) {
+	it := s.db.NewIterator(util.BytesPrefix([]byte(transactionPrefix)), nil)
+	defer it.Release()
+	var res []transaction
+	for ok := it.Last(); ok && len(res) < limit; ok = it.Prev() {
+		var t transaction
+		if err := json.Unmarshal(it.Value(), &t); err != nil {
+			return nil, err
+		}
+		if chargePoint != "" && t.ChargePoint != chargePoint {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res, it.Error()
+}
+
+// SetRef records the ID another system knows the transaction by.
+func (s *transactionStore) SetRef(id int, ref string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	t, ok := s.active[id]
+	if !ok {
+		var err error
+		if t, err = s.get(id); err != nil {
+			return err
+		}
+	}
+	t.Ref = ref
+	return s.put(t)
+}
+
+// RefFor returns the ref of the transaction, if it has one.
+func (s *transactionStore) RefFor(id int) (string, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	t, ok := s.active[id]
+	if !ok {
+		var err error
+		if t, err = s.get(id); err != nil {
+			return "", false
+		}
+	}
+	return t.Ref, t.Ref != ""
+}
+
+func (s *transactionStore) get(id int) (*transaction, error) {
+	bs, err := s.db.Get(transactionKey(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var t transaction
+	if err := json.Unmarshal(bs, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *transactionStore) put(t *transaction) error {
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(transactionKey(t.ID), bs, nil)
+}
+
+func transactionKey(id int) []byte {
+	return binary.BigEndian.AppendUint64([]byte(transactionPrefix), uint64(id))
+}
+
+var sessionDurationDesc = prometheus.NewDesc("charger_session_duration_seconds", "", []string{"chargepoint", "connector"}, nil)
+
+func (s *transactionStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionDurationDesc
+}
+
+// Collect exports the duration of the active sessions.
+func (s *transactionStore) Collect(ch chan<- prometheus.Metric) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, t := range s.active {
+		ch <- prometheus.MustNewConstMetric(sessionDurationDesc, prometheus.GaugeValue, time.Since(t.Started).Seconds(), t.labels()...)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTransactionStore(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, err := newTransactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tx, err := s.Start("cp1", 1, "tag", 1000, start, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.ID != 1 {
+		t.Errorf("first transaction has ID %d", tx.ID)
+	}
+	if err := s.Update(tx.ID, 1500); err != nil {
+		t.Fatal(err)
+	}
+	// An older reading sent late.
+	if err := s.Update(tx.ID, 1200); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start("cp2", 1, "tag", 0, start, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another charger can't stop it.
+	if _, err := s.Stop("cp2", tx.ID, 3000, start, "Local"); err != errOtherChargePoint {
+		t.Errorf("stop from another charger gave %v", err)
+	}
+
+	// A restart keeps the sequence and the ongoing transactions.
+	s, err = newTransactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.active) != 2 || s.active[1].MeterLast != 1500 {
+		t.Fatalf("unexpected active transactions after reload: %v", s.active)
+	}
+	tx, err = s.Stop("cp1", 1, 2500, start.Add(time.Hour), "Local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.EnergyWh() != 1500 || tx.IDTag != "tag" {
+		t.Errorf("unexpected stopped transaction %+v", tx)
+	}
+	// A resent stop changes nothing.
+	if _, err := s.Stop("cp1", 1, 3000, start.Add(2*time.Hour), "Local"); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := s.Start("cp1", 1, "tag", 2500, start.Add(3*time.Hour), ""); err != nil || tx.ID != 3 {
+		t.Fatalf("third transaction %v, %v", tx, err)
+	}
+
+	// A transaction we failed to store gets its ID from the sequence, and
+	// the charger's stop for it doesn't move the sequence on.
+	if id := s.ReserveID(); id != 4 {
+		t.Errorf("reserved ID %d", id)
+	}
+	if _, err := s.Stop("cp1", 4, 2600, start.Add(4*time.Hour), "Local"); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := s.Start("cp2", 2, "tag", 0, start.Add(5*time.Hour), ""); err != nil || tx.ID != 5 {
+		t.Fatalf("transaction after the reserved one %v, %v", tx, err)
+	}
+
+	recent, err := s.Recent(10, "cp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 3 || recent[0].ID != 4 || recent[1].ID != 3 || recent[2].ID != 1 || *recent[2].MeterStop != 2500 {
+		t.Errorf("unexpected recent transactions %+v", recent)
+	}
+}
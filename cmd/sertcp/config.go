@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"go.bug.st/serial"
+)
+
+// config is the on-disk configuration format, a JSON file listing each
+// serial port to open and the TCP listeners that expose it.
+type config struct {
+	Ports []portConfig `json:"ports"`
+}
+
+type portConfig struct {
+	Device    string           `json:"device"` // device path, preferably a stable /dev/serial/by-id link
+	USB       string           `json:"usb"`    // alternatively, VID:PID[:serial] looked up when opening
+	BaudRate  int              `json:"baudRate"`
+	Parity    string           `json:"parity"`   // none, odd, even, mark, space
+	DataBits  int              `json:"dataBits"` // 5-8
+	StopBits  string           `json:"stopBits"` // 1, 1.5, 2
+	RTS       *bool            `json:"rts"`      // nil leaves the line alone
+	DTR       *bool            `json:"dtr"`      // nil leaves the line alone
+	Framing   string           `json:"framing"`  // newline, dsmr, nmea; raw chunks when empty
+	Listeners []listenerConfig `json:"listeners"`
+	UDP       []udpConfig      `json:"udp"`
+}
+
+type listenerConfig struct {
+	Address    string     `json:"address"`
+	Protocol   string     `json:"protocol"`   // raw (default) or rfc2217
+	Write      string     `json:"write"`      // write policy; empty means read only
+	Writers    []string   `json:"writers"`    // addresses or CIDRs allowed to write with the "designated" policy
+	Allow      []string   `json:"allow"`      // addresses or CIDRs allowed to connect; everyone when empty
+	MaxClients int        `json:"maxClients"` // zero for no limit
+	Replay     int        `json:"replay"`     // recent data sent to new clients first: frames on framed ports, otherwise bytes
+	TLS        *tlsConfig `json:"tls"`
+}
+
+// udpConfig is a destination for datagrams of the port's data, one per
+// chunk or, on framed ports, per frame.
+type udpConfig struct {
+	Address   string  `json:"address"`   // unicast or multicast host:port
+	Rate      float64 `json:"rate"`      // datagrams per second on average
+	Burst     int     `json:"burst"`     // datagrams allowed in a burst above the rate
+	TTL       int     `json:"ttl"`       // multicast TTL; system default (1) when zero
+	Interface string  `json:"interface"` // multicast interface name; system default when empty
+}
+
+func (c *udpConfig) setDefaults() {
+	if c.Rate == 0 {
+		c.Rate = 10
+	}
+	if c.Burst == 0 {
+		c.Burst = max(1, int(c.Rate))
+	}
+}
+
+func (c *udpConfig) validate() error {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return fmt.Errorf("udp: %w", err)
+	}
+	if c.Rate < 0 || c.Burst < 0 {
+		return fmt.Errorf("udp %s: invalid rate limit", c.Address)
+	}
+	if c.TTL < 0 || c.TTL > 255 {
+		return fmt.Errorf("udp %s: invalid TTL %d", c.Address, c.TTL)
+	}
+	if ip := net.ParseIP(host); (c.TTL != 0 || c.Interface != "") && (ip == nil || ip.To4() == nil || !ip.IsMulticast()) {
+		return fmt.Errorf("udp %s: TTL and interface apply to IPv4 multicast destinations only", c.Address)
+	}
+	return nil
+}
+
+type tlsConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"clientCA"` // when set, clients must present a certificate signed by this CA
+}
+
+const (
+	protocolRaw     = "raw"
+	protocolRFC2217 = "rfc2217"
+)
+
+// Write policies for clients sending data towards the serial port.
+const (
+	writeNone       = ""
+	writeExclusive  = "exclusive"  // the first client to write holds the port until it disconnects
+	writeAll        = "all"        // every client may write
+	writeDesignated = "designated" // only clients matching Writers may write
+)
+
+func loadConfig(path string) (*config, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(bs, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(cfg.Ports) == 0 {
+		return nil, fmt.Errorf("%s: no ports configured", path)
+	}
+	for i := range cfg.Ports {
+		cfg.Ports[i].setDefaults()
+		if err := cfg.Ports[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (c *portConfig) setDefaults() {
+	if c.BaudRate == 0 {
+		c.BaudRate = 115200
+	}
+	if c.Parity == "" {
+		c.Parity = "none"
+	}
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+	if c.StopBits == "" {
+		c.StopBits = "1"
+	}
+	for i := range c.UDP {
+		c.UDP[i].setDefaults()
+	}
+}
+
+func (c *portConfig) validate() error {
+	if (c.Device == "") == (c.USB == "") {
+		return fmt.Errorf("port needs exactly one of device or usb")
+	}
+	if c.USB != "" {
+		if vid, pid, _ := c.usbIDs(); vid == "" || pid == "" {
+			return fmt.Errorf("invalid USB device %q, expected VID:PID[:serial]", c.USB)
+		}
+	}
+	if len(c.Listeners) == 0 && len(c.UDP) == 0 {
+		return fmt.Errorf("%s: no listeners or UDP destinations", c.name())
+	}
+	switch c.Framing {
+	case framingRaw, framingNewline, framingDSMR, framingNMEA:
+	default:
+		return fmt.Errorf("%s: invalid framing %q", c.name(), c.Framing)
+	}
+	for _, lc := range c.Listeners {
+		if err := lc.validate(); err != nil {
+			return fmt.Errorf("%s: %w", c.name(), err)
+		}
+	}
+	for _, uc := range c.UDP {
+		if err := uc.validate(); err != nil {
+			return fmt.Errorf("%s: %w", c.name(), err)
+		}
+	}
+	_, err := c.mode()
+	return err
+}
+
+var parities = map[string]serial.Parity{
+	"none":  serial.NoParity,
+	"odd":   serial.OddParity,
+	"even":  serial.EvenParity,
+	"mark":  serial.MarkParity,
+	"space": serial.SpaceParity,
+}
+
+var stopBits = map[string]serial.StopBits{
+	"1":   serial.OneStopBit,
+	"1.5": serial.OnePointFiveStopBits,
+	"2":   serial.TwoStopBits,
+}
+
+func (c *portConfig) mode() (*serial.Mode, error) {
+	parity, ok := parities[c.Parity]
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid parity %q", c.name(), c.Parity)
+	}
+	stop, ok := stopBits[c.StopBits]
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid stop bits %q", c.name(), c.StopBits)
+	}
+	if c.DataBits < 5 || c.DataBits > 8 {
+		return nil, fmt.Errorf("%s: invalid data bits %d", c.name(), c.DataBits)
+	}
+	if c.BaudRate <= 0 {
+		return nil, fmt.Errorf("%s: invalid baud rate %d", c.name(), c.BaudRate)
+	}
+	return &serial.Mode{
+		BaudRate: c.BaudRate,
+		Parity:   parity,
+		DataBits: c.DataBits,
+		StopBits: stop,
+	}, nil
+}
+
+func (c *listenerConfig) validate() error {
+	switch c.Protocol {
+	case "", protocolRaw, protocolRFC2217:
+	default:
+		return fmt.Errorf("%s: invalid protocol %q", c.Address, c.Protocol)
+	}
+	switch c.Write {
+	case writeNone, writeExclusive, writeAll:
+	case writeDesignated:
+		if len(c.Writers) == 0 {
+			return fmt.Errorf("%s: designated write policy without writers", c.Address)
+		}
+	default:
+		return fmt.Errorf("%s: invalid write policy %q", c.Address, c.Write)
+	}
+	if _, err := parseNets(c.Writers); err != nil {
+		return fmt.Errorf("%s: writers: %w", c.Address, err)
+	}
+	if _, err := parseNets(c.Allow); err != nil {
+		return fmt.Errorf("%s: allow: %w", c.Address, err)
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("%s: invalid max clients %d", c.Address, c.MaxClients)
+	}
+	if c.Replay < 0 {
+		return fmt.Errorf("%s: invalid replay %d", c.Address, c.Replay)
+	}
+	if c.TLS != nil && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		return fmt.Errorf("%s: TLS needs both cert and key", c.Address)
+	}
+	return nil
+}
+
+func (c *tlsConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA != "" {
+		bs, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("%s: no certificates found", c.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// parseNets parses a list of addresses and CIDR networks. A plain address
+// is taken as a single host network.
+func parseNets(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", addr)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Framing modes for splitting the serial stream before fanout.
+const (
+	framingRaw     = ""
+	framingNewline = "newline"
+	framingDSMR    = "dsmr" // "/" ... "!CRC" telegrams, as sent by P1/HAN meters
+	framingNMEA    = "nmea" // "$" ... "*CS" sentences
+)
+
+// maxFrameSize bounds the buffered partial frame. A stream that goes this
+// long without completing a frame is not what we think it is.
+const maxFrameSize = 64 << 10
+
+// framer accumulates serial data and returns the complete frames in it.
+// Data outside of frames is discarded, as are frames that fail their
+// checksum.
+type framer struct {
+	mode    string
+	buf     []byte
+	invalid int // frames discarded since last asked
+}
+
+func newFramer(mode string) *framer {
+	return &framer{mode: mode}
+}
+
+// Push adds data to the buffer and returns the frames completed by it.
+func (f *framer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for {
+		frame, ok := f.next()
+		if !ok {
+			break
+		}
+		if frame != nil {
+			frames = append(frames, frame)
+		}
+	}
+	if len(f.buf) > maxFrameSize {
+		f.buf = f.buf[:0]
+		f.invalid++
+	}
+	return frames
+}
+
+// Invalid returns the number of frames discarded since the last call.
+func (f *framer) Invalid() int {
+	n := f.invalid
+	f.invalid = 0
+	return n
+}
+
+// next extracts the next frame from the buffer. It returns ok when it
+// made progress; the frame is nil if what was consumed was discarded.
+func (f *framer) next() (frame []byte, ok bool) {
+	switch f.mode {
+	case framingNewline:
+		end := bytes.IndexByte(f.buf, '\n')
+		if end < 0 {
+			return nil, false
+		}
+		return f.take(0, end+1, true), true
+
+	case framingDSMR:
+		start := f.lineStart('/')
+		if start < 0 {
+			return nil, false
+		}
+		bang := bytes.IndexByte(f.buf[start:], '!')
+		if bang < 0 {
+			return nil, false
+		}
+		bang += start
+		end := bytes.IndexByte(f.buf[bang:], '\n')
+		if end < 0 {
+			return nil, false
+		}
+		end += bang
+		crc := string(bytes.TrimSpace(f.buf[bang+1 : end]))
+		valid := crc == "" || checkCRC16(f.buf[start:bang+1], crc)
+		return f.take(start, end+1, valid), true
+
+	case framingNMEA:
+		start := bytes.IndexAny(f.buf, "$!")
+		if start < 0 {
+			f.buf = f.buf[:0]
+			return nil, false
+		}
+		end := bytes.IndexByte(f.buf[start:], '\n')
+		if end < 0 {
+			f.buf = f.buf[start:]
+			return nil, false
+		}
+		end += start
+		// A new start character before the end of line means the previous
+		// sentence was cut short; resynchronize on the new one.
+		if restart := bytes.IndexAny(f.buf[start+1:end], "$!"); restart >= 0 {
+			f.invalid++
+			f.buf = f.buf[start+1+restart:]
+			return nil, true
+		}
+		valid := checkNMEA(bytes.TrimSpace(f.buf[start:end]))
+		return f.take(start, end+1, valid), true
+	}
+
+	return nil, false
+}
+
+// lineStart returns the index of the first occurrence of c at the start of
+// a line, discarding any data before it that can't be part of a frame.
+func (f *framer) lineStart(c byte) int {
+	if len(f.buf) > 0 && f.buf[0] == c {
+		return 0
+	}
+	if i := bytes.Index(f.buf, []byte{'\n', c}); i >= 0 {
+		return i + 1
+	}
+	if nl := bytes.LastIndexByte(f.buf, '\n'); nl >= 0 {
+		f.buf = f.buf[nl+1:]
+	}
+	return -1
+}
+
+// take removes buf[:end] and returns a copy of buf[start:end] if valid.
+func (f *framer) take(start, end int, valid bool) []byte {
+	var frame []byte
+	if valid {
+		frame = bytes.Clone(f.buf[start:end])
+	} else {
+		f.invalid++
+	}
+	f.buf = f.buf[:copy(f.buf, f.buf[end:])]
+	return frame
+}
+
+// checkCRC16 verifies a DSMR telegram checksum, CRC16/ARC over everything
+// from the "/" up to and including the "!".
+func checkCRC16(data []byte, expected string) bool {
+	want, err := strconv.ParseUint(expected, 16, 16)
+	if err != nil {
+		return false
+	}
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc == uint16(want)
+}
+
+// checkNMEA verifies the XOR checksum of an NMEA sentence, if it has one.
+func checkNMEA(sentence []byte) bool {
+	star := bytes.LastIndexByte(sentence, '*')
+	if star < 0 {
+		return true
+	}
+	want, err := strconv.ParseUint(string(sentence[star+1:]), 16, 8)
+	if err != nil {
+		return false
+	}
+	var cs byte
+	for _, b := range sentence[1:star] {
+		cs ^= b
+	}
+	return cs == byte(want)
+}
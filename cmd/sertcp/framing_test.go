@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const dsmrTelegram = "/ELL5\\253833635_A\r\n\r\n" +
+	"0-0:1.0.0(210217184019W)\r\n" +
+	"1-0:1.8.0(00006678.394*kWh)\r\n" +
+	"1-0:2.8.0(00000000.000*kWh)\r\n" +
+	"1-0:3.8.0(00000021.988*kvarh)\r\n" +
+	"1-0:4.8.0(00001020.971*kvarh)\r\n" +
+	"1-0:1.7.0(0001.727*kW)\r\n" +
+	"1-0:2.7.0(0000.000*kW)\r\n" +
+	"1-0:3.7.0(0000.000*kvar)\r\n" +
+	"1-0:4.7.0(0000.309*kvar)\r\n" +
+	"1-0:21.7.0(0001.023*kW)\r\n" +
+	"1-0:41.7.0(0000.350*kW)\r\n" +
+	"1-0:61.7.0(0000.353*kW)\r\n" +
+	"1-0:22.7.0(0000.000*kW)\r\n" +
+	"1-0:42.7.0(0000.000*kW)\r\n" +
+	"1-0:62.7.0(0000.000*kW)\r\n" +
+	"1-0:23.7.0(0000.000*kvar)\r\n" +
+	"1-0:43.7.0(0000.000*kvar)\r\n" +
+	"1-0:63.7.0(0000.000*kvar)\r\n" +
+	"1-0:24.7.0(0000.009*kvar)\r\n" +
+	"1-0:44.7.0(0000.161*kvar)\r\n" +
+	"1-0:64.7.0(0000.138*kvar)\r\n" +
+	"1-0:32.7.0(240.3*V)\r\n" +
+	"1-0:52.7.0(240.1*V)\r\n" +
+	"1-0:72.7.0(241.3*V)\r\n" +
+	"1-0:31.7.0(004.2*A)\r\n" +
+	"1-0:51.7.0(001.6*A)\r\n" +
+	"1-0:71.7.0(001.7*A)\r\n" +
+	"!7945\r\n"
+
+func TestFramerDSMR(t *testing.T) {
+	// A partial telegram, a complete one split at every possible point,
+	// one with a bad checksum and then a good one again.
+	stream := dsmrTelegram[200:] + dsmrTelegram +
+		strings.Replace(dsmrTelegram, "0001.727", "0001.728", 1) + dsmrTelegram
+
+	for split := 1; split < len(stream); split += 7 {
+		f := newFramer(framingDSMR)
+		var frames [][]byte
+		frames = append(frames, f.Push([]byte(stream[:split]))...)
+		frames = append(frames, f.Push([]byte(stream[split:]))...)
+		if len(frames) != 2 {
+			t.Fatalf("split %d: got %d frames, expected 2", split, len(frames))
+		}
+		for _, frame := range frames {
+			if string(frame) != dsmrTelegram {
+				t.Fatalf("split %d: unexpected frame %q", split, frame)
+			}
+		}
+		if inv := f.Invalid(); inv != 1 {
+			t.Errorf("split %d: %d invalid frames, expected 1", split, inv)
+		}
+	}
+}
+
+func TestFramerNMEA(t *testing.T) {
+	const gga = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n"
+	const bad = "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48\r\n"
+	const cut = "$GPGSA,A,3,04,05,,09"
+
+	f := newFramer(framingNMEA)
+	frames := f.Push([]byte("M,,*47\r\n" + gga + bad + cut + gga[:10]))
+	frames = append(frames, f.Push([]byte(gga[10:]))...)
+	if len(frames) != 2 || string(frames[0]) != gga || string(frames[1]) != gga {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+	if inv := f.Invalid(); inv != 2 {
+		t.Errorf("%d invalid frames, expected 2", inv)
+	}
+}
+
+func TestFramerNewline(t *testing.T) {
+	f := newFramer(framingNewline)
+	frames := f.Push([]byte("one\ntw"))
+	frames = append(frames, f.Push([]byte("o\nthr"))...)
+	if len(frames) != 2 || string(frames[0]) != "one\n" || string(frames[1]) != "two\n" {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+}
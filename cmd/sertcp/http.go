@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func serveHTTP(addr string, ports []*port, healthWindow time.Duration) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(ports, healthWindow))
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// healthHandler reports unhealthy when any port has gone longer than the
+// window without delivering data. Ports that never delivered anything are
+// measured from startup. A zero window disables the check.
+func healthHandler(ports []*port, window time.Duration) http.Handler {
+	started := time.Now()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		var body string
+		for _, p := range ports {
+			last := p.LastRead()
+			if last.IsZero() {
+				last = started
+			}
+			age := time.Since(last).Truncate(time.Second)
+			state := "ok"
+			if window > 0 && age > window {
+				state = "stale"
+				status = http.StatusServiceUnavailable
+			}
+			body += fmt.Sprintf("%s: %s, last data %v ago\n", p.dev, state, age)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		reads  []time.Duration // ago, per port; zero for never
+		window time.Duration
+		status int
+		body   string
+	}{
+		{"fresh", []time.Duration{time.Second}, time.Minute, http.StatusOK, "p0: ok"},
+		{"stale", []time.Duration{time.Second, time.Hour}, time.Minute, http.StatusServiceUnavailable, "p1: stale"},
+		{"never read, just started", []time.Duration{0}, time.Minute, http.StatusOK, "p0: ok"},
+		{"check disabled", []time.Duration{time.Hour}, 0, http.StatusOK, "p0: ok"},
+	}
+	for _, c := range cases {
+		var ports []*port
+		for i, ago := range c.reads {
+			p := &port{dev: "p" + string(rune('0'+i))}
+			if ago != 0 {
+				p.lastRead.Store(now.Add(-ago).UnixNano())
+			}
+			ports = append(ports, p)
+		}
+		w := httptest.NewRecorder()
+		healthHandler(ports, c.window).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s: %d %q", c.name, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"calmh.dev/homeprom/internal/fanout"
+)
+
+// listener accepts TCP clients for a port and streams the serial data to
+// them. Depending on the write policy, client data is written back to the
+// serial port.
+type listener struct {
+	cfg     listenerConfig
+	port    *port
+	writers []*net.IPNet
+	allow   []*net.IPNet
+	tls     *tls.Config
+	conns   atomic.Int32
+
+	mut   sync.Mutex
+	owner net.Conn // holder of the write lock under the exclusive policy
+}
+
+func newListener(lc listenerConfig, p *port) *listener {
+	writers, err := parseNets(lc.Writers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	allow, err := parseNets(lc.Allow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := &listener{cfg: lc, port: p, writers: writers, allow: allow}
+	if lc.TLS != nil {
+		l.tls, err = lc.TLS.load()
+		if err != nil {
+			log.Fatalf("%s: %v", lc.Address, err)
+		}
+	}
+	return l
+}
+
+func (l *listener) Serve() {
+	list, err := net.Listen("tcp", l.cfg.Address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if l.tls != nil {
+		list = tls.NewListener(list, l.tls)
+	}
+	for {
+		conn, err := list.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reason := l.reject(conn); reason != "" {
+			log.Printf("%s: rejected %v: %s", l.cfg.Address, conn.RemoteAddr(), reason)
+			clientsRejected.WithLabelValues(l.port.dev, l.cfg.Address, reason).Inc()
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer l.conns.Add(-1)
+			l.handleConn(conn)
+		}()
+	}
+}
+
+// reject returns the reason for turning the client away, or the empty
+// string if it's welcome. Welcome clients are counted towards the limit.
+func (l *listener) reject(conn net.Conn) string {
+	if len(l.allow) > 0 && !addrInNets(conn.RemoteAddr(), l.allow) {
+		return "not allowed"
+	}
+	if n := l.conns.Add(1); l.cfg.MaxClients > 0 && int(n) > l.cfg.MaxClients {
+		l.conns.Add(-1)
+		return "too many clients"
+	}
+	return ""
+}
+
+func (l *listener) handleConn(conn net.Conn) {
+	var client io.ReadWriteCloser = conn
+	if l.cfg.Protocol == protocolRFC2217 {
+		client = newRFC2217Conn(conn, l)
+	}
+
+	connected := clients.WithLabelValues(l.port.dev, l.cfg.Address)
+	connected.Inc()
+	defer connected.Dec()
+	labels := []string{l.port.dev, l.cfg.Address, conn.RemoteAddr().String()}
+	sent := clientSentBytes.WithLabelValues(labels...)
+	defer clientSentBytes.DeleteLabelValues(labels...)
+	sub := l.port.lines.Listen(fanout.Options{
+		OnDrop: clientDropped.WithLabelValues(labels...).Inc,
+		Replay: l.cfg.Replay,
+	})
+	defer clientDropped.DeleteLabelValues(labels...)
+	defer sub.Close()
+	defer client.Close()
+
+	done := make(chan struct{})
+	if l.cfg.Write != writeNone || l.cfg.Protocol == protocolRFC2217 {
+		// RFC 2217 clients need to be read regardless, for the
+		// negotiation and port control commands.
+		go func() {
+			defer close(done)
+			l.readClient(conn, client)
+		}()
+	}
+
+	for {
+		select {
+		case line, ok := <-sub.Channel():
+			if !ok {
+				return
+			}
+			n, err := client.Write([]byte(line))
+			sent.Add(float64(n))
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// readClient copies data from the client to the serial port, for as long
+// as the client stays connected and the write policy permits it.
+func (l *listener) readClient(conn net.Conn, r io.Reader) {
+	defer l.releaseWrite(conn)
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if !l.mayWrite(conn) {
+				clientWritesRejected.WithLabelValues(l.port.dev, l.cfg.Address).Inc()
+			} else if _, err := l.port.Write(buf[:n]); err != nil {
+				log.Printf("write %s: %v", l.port.dev, err)
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+func (l *listener) mayWrite(conn net.Conn) bool {
+	switch l.cfg.Write {
+	case writeAll:
+		return true
+	case writeExclusive:
+		l.mut.Lock()
+		defer l.mut.Unlock()
+		if l.owner == nil {
+			log.Printf("%s: write lock taken by %v", l.port.dev, conn.RemoteAddr())
+			l.owner = conn
+		}
+		return l.owner == conn
+	case writeDesignated:
+		return addrInNets(conn.RemoteAddr(), l.writers)
+	default:
+		return false
+	}
+}
+
+// canWrite is whether the client may write, without taking the write lock
+// under the exclusive policy. It's for changing the port settings, which
+// shouldn't lock out the clients that do write.
+func (l *listener) canWrite(conn net.Conn) bool {
+	if l.cfg.Write != writeExclusive {
+		return l.mayWrite(conn)
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.owner == nil || l.owner == conn
+}
+
+func (l *listener) releaseWrite(conn net.Conn) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.owner == conn {
+		log.Printf("%s: write lock released by %v", l.port.dev, conn.RemoteAddr())
+		l.owner = nil
+	}
+}
+
+func addrInNets(addr net.Addr, nets []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"calmh.dev/homeprom/internal/testcert"
+)
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestListenerReject(t *testing.T) {
+	cases := []struct {
+		allow      []string
+		maxClients int
+		connected  int32
+		remote     string
+		reason     string
+	}{
+		{nil, 0, 0, "192.0.2.1", ""},
+		{[]string{"192.0.2.0/24"}, 0, 0, "192.0.2.1", ""},
+		{[]string{"192.0.2.0/24", "2001:db8::1"}, 0, 0, "2001:db8::1", ""},
+		{[]string{"192.0.2.0/24"}, 0, 0, "198.51.100.1", "not allowed"},
+		{[]string{"192.0.2.1"}, 0, 0, "192.0.2.2", "not allowed"},
+		{nil, 2, 1, "192.0.2.1", ""},
+		{nil, 2, 2, "192.0.2.1", "too many clients"},
+		{[]string{"192.0.2.0/24"}, 1, 1, "198.51.100.1", "not allowed"},
+	}
+	for _, c := range cases {
+		allow, err := parseNets(c.allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &listener{cfg: listenerConfig{MaxClients: c.maxClients}, allow: allow}
+		l.conns.Store(c.connected)
+		conn := addrConn{addr: &net.TCPAddr{IP: net.ParseIP(c.remote), Port: 1234}}
+		if reason := l.reject(conn); reason != c.reason {
+			t.Errorf("%+v: got %q", c, reason)
+		}
+		// Only the welcome are counted.
+		want := c.connected
+		if c.reason == "" {
+			want++
+		}
+		if l.conns.Load() != want {
+			t.Errorf("%+v: %d counted", c, l.conns.Load())
+		}
+	}
+}
+
+func TestListenerTLS(t *testing.T) {
+	files := testcert.New(t)
+	cases := []struct {
+		name     string
+		clientCA bool
+		cert     *tls.Certificate
+		ok       bool
+	}{
+		{"TLS", false, nil, true},
+		{"mTLS with certificate", true, ptr(files.Client(t, "client")), true},
+		{"mTLS without certificate", true, nil, false},
+		{"mTLS with untrusted certificate", true, ptr(testcert.Untrusted(t, "client")), false},
+	}
+	for _, c := range cases {
+		tc := tlsConfig{Cert: files.Cert, Key: files.Key}
+		if c.clientCA {
+			tc.ClientCA = files.CA
+		}
+		cfg, err := tc.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := handshake(t, cfg, files.Pool(), c.cert); got != c.ok {
+			t.Errorf("%s: handshake ok %v", c.name, got)
+		}
+	}
+}
+
+// handshake returns whether a client with the certificate gets data from
+// a server with the configuration.
+func handshake(t *testing.T, cfg *tls.Config, roots *x509.CertPool, cert *tls.Certificate) bool {
+	t.Helper()
+	list, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	go func() {
+		conn, err := tls.NewListener(list, cfg).Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ok"))
+	}()
+
+	clientCfg := &tls.Config{ServerName: "localhost", RootCAs: roots}
+	if cert != nil {
+		clientCfg.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", list.Addr().String(), clientCfg)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == "ok"
+}
+
+func ptr[T any](v T) *T { return &v }
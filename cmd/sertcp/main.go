@@ -2,64 +2,106 @@ package main
 
 import (
 	"flag"
-	"io"
 	"log"
-	"net"
-
-	"go.bug.st/serial"
+	"strings"
+	"time"
 )
 
 func main() {
-	port := flag.String("serial", "/dev/ttyUSB0", "Serial port")
+	httpListen := flag.String("http", "0.0.0.0:2116", "HTTP listener address for metrics and health checks (empty to disable)")
+	healthWindow := flag.Duration("health-window", time.Minute, "Report unhealthy when a port has been silent for longer than this (0 to disable)")
+	configFile := flag.String("config", "", "JSON configuration file (overrides the serial port flags)")
+	device := flag.String("serial", "/dev/ttyUSB0", "Serial port")
+	usb := flag.String("usb", "", "USB serial device as VID:PID[:serial], instead of -serial")
 	listen := flag.String("listen", "0.0.0.0:2113", "Listen address")
+	baudRate := flag.Int("baud", 115200, "Baud rate")
+	parity := flag.String("parity", "none", "Parity (none, odd, even, mark, space)")
+	dataBits := flag.Int("databits", 8, "Data bits")
+	stopBits := flag.String("stopbits", "1", "Stop bits (1, 1.5, 2)")
+	rts := flag.Bool("rts", false, "RTS line state (unchanged unless given)")
+	dtr := flag.Bool("dtr", false, "DTR line state (unchanged unless given)")
+	framing := flag.String("framing", "", "Fan out complete frames only (newline, dsmr, nmea; default raw chunks)")
+	protocol := flag.String("protocol", "raw", "Client protocol (raw, rfc2217)")
+	write := flag.String("write", "", "Client write policy (exclusive, all, designated; default read only)")
+	writers := flag.String("writers", "", "Comma separated addresses or networks allowed to write with the designated policy")
+	allow := flag.String("allow", "", "Comma separated addresses or networks allowed to connect (default everyone)")
+	maxClients := flag.Int("max-clients", 0, "Maximum number of connected clients (0 for no limit)")
+	replay := flag.Int("replay", 0, "Recent data sent to new clients first: frames when framing, otherwise bytes")
+	udp := flag.String("udp", "", "Comma separated unicast or multicast addresses to also send data to as datagrams")
+	udpRate := flag.Float64("udp-rate", 10, "Maximum average UDP datagrams per second, per destination")
+	udpTTL := flag.Int("udp-ttl", 0, "Multicast TTL (default system setting)")
+	udpInterface := flag.String("udp-interface", "", "Multicast interface (default system setting)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate, enables TLS on the listener")
+	tlsKey := flag.String("tls-key", "", "TLS certificate key")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificate to require and verify client certificates with")
 	flag.Parse()
 
-	fd, err := serial.Open(*port, &serial.Mode{
-		BaudRate: 115200,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
-	})
-	if err != nil {
-		log.Fatalf("open %s: %v", *port, err)
-	}
-
-	lines := NewFanout[string]()
-	go readLines(fd, lines)
-
-	list, err := net.Listen("tcp", *listen)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for {
-		conn, err := list.Accept()
+	var cfg *config
+	if *configFile != "" {
+		var err error
+		cfg, err = loadConfig(*configFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		go handleConn(conn, lines)
-	}
-}
-
-func readLines(r io.Reader, lines *fanout[string]) {
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Read(buf)
-		if err != nil {
+	} else {
+		pc := portConfig{
+			Device:    *device,
+			USB:       *usb,
+			BaudRate:  *baudRate,
+			Parity:    *parity,
+			DataBits:  *dataBits,
+			StopBits:  *stopBits,
+			Framing:   *framing,
+			Listeners: []listenerConfig{{Address: *listen, Protocol: *protocol, Write: *write, MaxClients: *maxClients, Replay: *replay}},
+		}
+		if *usb != "" {
+			pc.Device = ""
+		}
+		if *writers != "" {
+			pc.Listeners[0].Writers = strings.Split(*writers, ",")
+		}
+		if *allow != "" {
+			pc.Listeners[0].Allow = strings.Split(*allow, ",")
+		}
+		if *tlsCert != "" || *tlsKey != "" {
+			pc.Listeners[0].TLS = &tlsConfig{Cert: *tlsCert, Key: *tlsKey, ClientCA: *tlsClientCA}
+		}
+		if *udp != "" {
+			for _, addr := range strings.Split(*udp, ",") {
+				uc := udpConfig{Address: addr, Rate: *udpRate, TTL: *udpTTL, Interface: *udpInterface}
+				uc.setDefaults()
+				pc.UDP = append(pc.UDP, uc)
+			}
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "rts":
+				pc.RTS = rts
+			case "dtr":
+				pc.DTR = dtr
+			}
+		})
+		if err := pc.validate(); err != nil {
 			log.Fatal(err)
 		}
-		lines.Publish(string(buf[:n]))
+		cfg = &config{Ports: []portConfig{pc}}
 	}
-}
 
-func handleConn(conn net.Conn, lines *fanout[string]) {
-	sub := lines.Listen()
-	defer sub.Close()
-	defer conn.Close()
-	for line := range sub.Channel() {
-		_, err := conn.Write([]byte(line))
-		if err != nil {
-			log.Println(err)
-			return
+	var ports []*port
+	for _, pc := range cfg.Ports {
+		p := newPort(pc)
+		ports = append(ports, p)
+		go p.Serve()
+		for _, lc := range pc.Listeners {
+			go newListener(lc, p).Serve()
+		}
+		for _, uc := range pc.UDP {
+			go newUDPOutput(uc, p).Serve()
 		}
 	}
+
+	if *httpListen != "" {
+		go serveHTTP(*httpListen, ports, *healthWindow)
+	}
+	select {}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	serialOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sertcp_serial_open",
+	}, []string{"device"})
+	serialOpenErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_open_errors_total",
+	}, []string{"device"})
+	serialReadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_read_bytes_total",
+	}, []string{"device"})
+	serialReadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_read_errors_total",
+	}, []string{"device"})
+	serialLastRead = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sertcp_serial_last_read_timestamp_seconds",
+	}, []string{"device"})
+	serialWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_writes_total",
+	}, []string{"device"})
+	serialWrittenBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_written_bytes_total",
+	}, []string{"device"})
+	serialFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_frames_total",
+	}, []string{"device"})
+	serialFramesInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_serial_frames_invalid_total",
+	}, []string{"device"})
+	clients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sertcp_clients",
+	}, []string{"device", "listener"})
+	clientsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_clients_rejected_total",
+	}, []string{"device", "listener", "reason"})
+	clientSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_client_sent_bytes_total",
+	}, []string{"device", "listener", "client"})
+	clientDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_client_dropped_total",
+	}, []string{"device", "listener", "client"})
+	udpSentDatagrams = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_udp_sent_datagrams_total",
+	}, []string{"device", "destination"})
+	udpSentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_udp_sent_bytes_total",
+	}, []string{"device", "destination"})
+	udpDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_udp_dropped_total",
+	}, []string{"device", "destination", "reason"})
+	clientWritesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sertcp_client_writes_rejected_total",
+	}, []string{"device", "listener"})
+)
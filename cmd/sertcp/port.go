@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"calmh.dev/homeprom/internal/fanout"
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	minReopenDelay = time.Second
+	maxReopenDelay = time.Minute
+)
+
+var errPortClosed = errors.New("serial port not open")
+
+// The system calls, replaced in tests.
+var (
+	openSerial = serial.Open
+	listPorts  = enumerator.GetDetailedPortsList
+	sleep      = time.Sleep
+)
+
+// port is a serial port, kept open for as long as the device exists and
+// reopened when it returns. Everything read from it is published to lines;
+// writes from clients are serialized through Write.
+type port struct {
+	dev   string // name used in logs and metrics
+	cfg   portConfig
+	lines *fanout.Fanout[string]
+	wmut  sync.Mutex
+
+	lastRead atomic.Int64 // unix nanoseconds
+
+	cmut sync.Mutex // protects the fields below
+	fd   serial.Port
+	mode serial.Mode
+	rts  bool
+	dtr  bool
+}
+
+func newPort(pc portConfig) *port {
+	mode, err := pc.mode()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &port{
+		dev:   pc.name(),
+		cfg:   pc,
+		lines: fanout.NewWithHistory(pc.history()),
+		mode:  *mode,
+		rts:   true, // the serial package raises both lines on open
+		dtr:   true,
+	}
+	if pc.RTS != nil {
+		p.rts = *pc.RTS
+	}
+	if pc.DTR != nil {
+		p.dtr = *pc.DTR
+	}
+	serialOpen.WithLabelValues(p.dev).Set(0)
+	return p
+}
+
+// LastRead returns the time data was last read from the port, or the zero
+// time if never.
+func (p *port) LastRead() time.Time {
+	ns := p.lastRead.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Serve opens the port and publishes what is read from it, reopening it
+// with backoff whenever it fails or disappears. The backoff starts over
+// once the port has delivered data, so a device that opens but can't be
+// read from is retried no faster than one that can't be opened.
+func (p *port) Serve() {
+	delay := minReopenDelay
+	for {
+		fd, err := p.open()
+		if err != nil {
+			serialOpenErrors.WithLabelValues(p.dev).Inc()
+			log.Printf("open %s: %v (retrying in %v)", p.dev, err, delay)
+			sleep(delay)
+			delay = min(2*delay, maxReopenDelay)
+			continue
+		}
+		log.Printf("opened %s", p.dev)
+		serialOpen.WithLabelValues(p.dev).Set(1)
+
+		lastRead := p.lastRead.Load()
+		err = p.readLines(fd)
+		p.cmut.Lock()
+		p.fd = nil
+		p.cmut.Unlock()
+		fd.Close()
+		serialOpen.WithLabelValues(p.dev).Set(0)
+		serialReadErrors.WithLabelValues(p.dev).Inc()
+		if p.lastRead.Load() != lastRead {
+			delay = minReopenDelay
+		}
+		log.Printf("read %s: %v (reopening in %v)", p.dev, err, delay)
+		sleep(delay)
+		delay = min(2*delay, maxReopenDelay)
+	}
+}
+
+// open opens the device with the current settings, which may have been
+// changed by clients since the last time it was open.
+func (p *port) open() (serial.Port, error) {
+	path, err := p.cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	fd, err := openSerial(path, &p.mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.SetRTS(p.rts); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("set RTS: %w", err)
+	}
+	if err := fd.SetDTR(p.dtr); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("set DTR: %w", err)
+	}
+	p.fd = fd
+	return fd, nil
+}
+
+func (p *port) readLines(fd serial.Port) error {
+	var fr *framer
+	if p.cfg.Framing != framingRaw {
+		// A fresh framer per open, as a partial frame from before an
+		// unplug won't be completed by whatever comes after it.
+		fr = newFramer(p.cfg.Framing)
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := fd.Read(buf)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		p.lastRead.Store(now.UnixNano())
+		serialLastRead.WithLabelValues(p.dev).Set(float64(now.UnixNano()) / 1e9)
+		serialReadBytes.WithLabelValues(p.dev).Add(float64(n))
+		if fr == nil {
+			p.lines.Publish(string(buf[:n]))
+			continue
+		}
+		for _, frame := range fr.Push(buf[:n]) {
+			serialFrames.WithLabelValues(p.dev).Inc()
+			p.lines.Publish(string(frame))
+		}
+		if inv := fr.Invalid(); inv > 0 {
+			serialFramesInvalid.WithLabelValues(p.dev).Add(float64(inv))
+		}
+	}
+}
+
+func (p *port) current() serial.Port {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	return p.fd
+}
+
+// Write writes all of bs to the serial port. Concurrent writers are
+// serialized so that one client's write is never interleaved with
+// another's.
+func (p *port) Write(bs []byte) (int, error) {
+	p.wmut.Lock()
+	defer p.wmut.Unlock()
+	fd := p.current()
+	if fd == nil {
+		return 0, errPortClosed
+	}
+	written := 0
+	for written < len(bs) {
+		n, err := fd.Write(bs[written:])
+		written += n
+		serialWrittenBytes.WithLabelValues(p.dev).Add(float64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	serialWrites.WithLabelValues(p.dev).Inc()
+	return written, nil
+}
+
+// Mode returns the current line settings.
+func (p *port) Mode() serial.Mode {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	return p.mode
+}
+
+// SetMode applies the changes made by fn to the line settings. The
+// resulting settings are returned, unchanged if the port rejected them.
+// While the port is closed the settings are kept for when it reopens.
+func (p *port) SetMode(fn func(*serial.Mode)) (serial.Mode, error) {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	mode := p.mode
+	fn(&mode)
+	if p.fd != nil {
+		if err := p.fd.SetMode(&mode); err != nil {
+			return p.mode, err
+		}
+	}
+	p.mode = mode
+	return p.mode, nil
+}
+
+// Lines returns the current RTS and DTR states.
+func (p *port) Lines() (rts, dtr bool) {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	return p.rts, p.dtr
+}
+
+func (p *port) SetRTS(rts bool) error {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	if p.fd != nil {
+		if err := p.fd.SetRTS(rts); err != nil {
+			return err
+		}
+	}
+	p.rts = rts
+	return nil
+}
+
+func (p *port) SetDTR(dtr bool) error {
+	p.cmut.Lock()
+	defer p.cmut.Unlock()
+	if p.fd != nil {
+		if err := p.fd.SetDTR(dtr); err != nil {
+			return err
+		}
+	}
+	p.dtr = dtr
+	return nil
+}
+
+func (p *port) ModemStatus() (*serial.ModemStatusBits, error) {
+	fd := p.current()
+	if fd == nil {
+		return nil, errPortClosed
+	}
+	return fd.GetModemStatusBits()
+}
+
+func (p *port) Break(d time.Duration) error {
+	fd := p.current()
+	if fd == nil {
+		return errPortClosed
+	}
+	return fd.Break(d)
+}
+
+// Purge discards buffered input and/or output.
+func (p *port) Purge(input, output bool) error {
+	fd := p.current()
+	if fd == nil {
+		return errPortClosed
+	}
+	if input {
+		if err := fd.ResetInputBuffer(); err != nil {
+			return err
+		}
+	}
+	if output {
+		return fd.ResetOutputBuffer()
+	}
+	return nil
+}
+
+// history returns what the port should remember for listeners that
+// replay recent data to new clients: the last complete frames on framed
+// ports, otherwise the last bytes.
+func (c *portConfig) history() fanout.History[string] {
+	replay := 0
+	for _, lc := range c.Listeners {
+		replay = max(replay, lc.Replay)
+	}
+	switch {
+	case replay == 0:
+		return nil
+	case c.Framing != framingRaw:
+		return fanout.NewValueHistory[string](replay)
+	default:
+		return fanout.NewByteHistory(replay)
+	}
+}
+
+// name returns the port's display name, which is the device path or the
+// USB identifiers when the device is looked up by those.
+func (c *portConfig) name() string {
+	if c.USB != "" {
+		return "usb:" + c.USB
+	}
+	return c.Device
+}
+
+// resolve returns the device path to open. Ports configured by USB
+// VID:PID[:serial] are looked up among the currently present devices.
+func (c *portConfig) resolve() (string, error) {
+	if c.USB == "" {
+		return c.Device, nil
+	}
+	ports, err := listPorts()
+	if err != nil {
+		return "", err
+	}
+	return c.findUSB(ports)
+}
+
+// findUSB returns the first of the ports that is the configured USB
+// device.
+func (c *portConfig) findUSB(ports []*enumerator.PortDetails) (string, error) {
+	vid, pid, serialNo := c.usbIDs()
+	for _, pd := range ports {
+		if !pd.IsUSB || !strings.EqualFold(pd.VID, vid) || !strings.EqualFold(pd.PID, pid) {
+			continue
+		}
+		if serialNo != "" && pd.SerialNumber != serialNo {
+			continue
+		}
+		return pd.Name, nil
+	}
+	return "", fmt.Errorf("no USB device %s present", c.USB)
+}
+
+func (c *portConfig) usbIDs() (vid, pid, serialNo string) {
+	vid, rest, _ := strings.Cut(c.USB, ":")
+	pid, serialNo, _ = strings.Cut(rest, ":")
+	return vid, pid, serialNo
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+func TestPortReopen(t *testing.T) {
+	fake := &fakeSerial{in: make(chan []byte)}
+	opens := []error{errors.New("gone"), errors.New("gone"), errors.New("gone"), nil, errors.New("gone again")}
+	openSerial = func(string, *serial.Mode) (serial.Port, error) {
+		err := errors.New("still gone")
+		if len(opens) > 0 {
+			err, opens = opens[0], opens[1:]
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Some data, then unplugged.
+		fake.in = make(chan []byte, 1)
+		fake.in <- []byte("x")
+		close(fake.in)
+		return fake, nil
+	}
+	delays := make(chan time.Duration)
+	done := make(chan struct{})
+	sleep = func(d time.Duration) {
+		select {
+		case delays <- d:
+		case <-done:
+			runtime.Goexit()
+		}
+	}
+	p := newPort(portConfig{Device: "/dev/test", BaudRate: 9600, Parity: "none", DataBits: 8, StopBits: "1"})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		p.Serve()
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-exited
+		openSerial, sleep = serial.Open, time.Sleep
+	})
+
+	// Doubling while the device is gone, starting over once it has
+	// delivered data.
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Second, 2 * time.Second} {
+		if got := <-delays; got != want {
+			t.Errorf("delay %v, expected %v", got, want)
+		}
+	}
+}
+
+func TestPortReadFails(t *testing.T) {
+	// Opens fine, but reads fail right away, every time.
+	fake := &fakeSerial{in: make(chan []byte)}
+	close(fake.in)
+	openSerial = func(string, *serial.Mode) (serial.Port, error) {
+		return fake, nil
+	}
+	delays := make(chan time.Duration)
+	done := make(chan struct{})
+	sleep = func(d time.Duration) {
+		select {
+		case delays <- d:
+		case <-done:
+			runtime.Goexit()
+		}
+	}
+	p := newPort(portConfig{Device: "/dev/test", BaudRate: 9600, Parity: "none", DataBits: 8, StopBits: "1"})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		p.Serve()
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-exited
+		openSerial, sleep = serial.Open, time.Sleep
+	})
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if got := <-delays; got != want {
+			t.Errorf("delay %v, expected %v", got, want)
+		}
+	}
+}
+
+func TestPortResolveUSB(t *testing.T) {
+	ports := []*enumerator.PortDetails{
+		{Name: "/dev/ttyS0"},
+		{Name: "/dev/ttyUSB0", IsUSB: true, VID: "0403", PID: "6001", SerialNumber: "A1"},
+		{Name: "/dev/ttyUSB1", IsUSB: true, VID: "0403", PID: "6001", SerialNumber: "B2"},
+		{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043"},
+	}
+	cases := []struct {
+		usb  string
+		name string
+	}{
+		{"0403:6001", "/dev/ttyUSB0"},
+		{"0403:6001:B2", "/dev/ttyUSB1"},
+		{"2341:0043", "/dev/ttyACM0"},
+		{"0403:6001:C3", ""},
+		{"1234:5678", ""},
+	}
+	for _, c := range cases {
+		pc := portConfig{USB: c.usb}
+		name, err := pc.findUSB(ports)
+		if name != c.name || (c.name == "") != (err != nil) {
+			t.Errorf("%s: got %q, %v", c.usb, name, err)
+		}
+	}
+	// VID and PID are hex, in whatever case the system has them.
+	pc := portConfig{USB: "10c4:ea60"}
+	if name, _ := pc.findUSB([]*enumerator.PortDetails{{Name: "/dev/cu.usb", IsUSB: true, VID: "10C4", PID: "EA60"}}); name != "/dev/cu.usb" {
+		t.Errorf("got %q", name)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Telnet protocol bytes (RFC 854) and the options we negotiate.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	optBinary  = 0
+	optSGA     = 3
+	optComPort = 44
+)
+
+// Com port control commands (RFC 2217). Responses from the server use the
+// command value plus 100.
+const (
+	cpcSignature         = 0
+	cpcSetBaudRate       = 1
+	cpcSetDataSize       = 2
+	cpcSetParity         = 3
+	cpcSetStopSize       = 4
+	cpcSetControl        = 5
+	cpcNotifyLineState   = 6
+	cpcNotifyModemState  = 7
+	cpcFlowSuspend       = 8
+	cpcFlowResume        = 9
+	cpcSetLineStateMask  = 10
+	cpcSetModemStateMask = 11
+	cpcPurgeData         = 12
+
+	cpcServerOffset = 100
+)
+
+// SET-CONTROL values
+const (
+	ctlFlowRequest  = 0
+	ctlFlowNone     = 1
+	ctlBreakRequest = 4
+	ctlBreakOn      = 5
+	ctlBreakOff     = 6
+	ctlDTRRequest   = 7
+	ctlDTROn        = 8
+	ctlDTROff       = 9
+	ctlRTSRequest   = 10
+	ctlRTSOn        = 11
+	ctlRTSOff       = 12
+)
+
+var rfc2217Parities = []serial.Parity{1: serial.NoParity, 2: serial.OddParity, 3: serial.EvenParity, 4: serial.MarkParity, 5: serial.SpaceParity}
+
+var rfc2217StopBits = []serial.StopBits{1: serial.OneStopBit, 2: serial.TwoStopBits, 3: serial.OnePointFiveStopBits}
+
+const modemPollInterval = time.Second
+
+const (
+	parseData = iota
+	parseIAC
+	parseVerb
+	parseSB
+	parseSBIAC
+)
+
+// rfc2217Conn speaks the Telnet Com Port Control Option on top of a client
+// connection. Reads return the client's data with the Telnet framing
+// removed, after acting on any negotiation and port control commands in
+// the stream. Writes escape the data for Telnet.
+type rfc2217Conn struct {
+	net.Conn
+	l *listener
+
+	wmut sync.Mutex
+
+	raw   []byte
+	state int
+	verb  byte
+	sb    []byte
+
+	local  map[byte]bool // options enabled on our side (WILL)
+	remote map[byte]bool // options enabled on the client's side (DO)
+
+	mmut      sync.Mutex
+	modemMask byte
+	lastModem byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newRFC2217Conn(conn net.Conn, l *listener) *rfc2217Conn {
+	c := &rfc2217Conn{
+		Conn:      conn,
+		l:         l,
+		raw:       make([]byte, 1024),
+		local:     make(map[byte]bool),
+		remote:    make(map[byte]bool),
+		modemMask: 0xff,
+		done:      make(chan struct{}),
+	}
+	c.request(telnetDO, optComPort)
+	c.request(telnetWILL, optBinary)
+	c.request(telnetDO, optBinary)
+	c.request(telnetWILL, optSGA)
+	c.request(telnetDO, optSGA)
+	go c.pollModemState()
+	return c
+}
+
+// Read returns client data with Telnet commands removed. It blocks until
+// at least one byte of data is available.
+func (c *rfc2217Conn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(c.raw[:min(len(p), len(c.raw))])
+		out := c.parse(c.raw[:n], p[:0])
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// Write sends data to the client, doubling any IAC bytes.
+func (c *rfc2217Conn) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+8)
+	for _, b := range p {
+		buf = append(buf, b)
+		if b == telnetIAC {
+			buf = append(buf, telnetIAC)
+		}
+	}
+	if err := c.send(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *rfc2217Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *rfc2217Conn) send(bs []byte) error {
+	c.wmut.Lock()
+	defer c.wmut.Unlock()
+	_, err := c.Conn.Write(bs)
+	return err
+}
+
+// parse runs the Telnet state machine over in, appending data bytes to out.
+func (c *rfc2217Conn) parse(in, out []byte) []byte {
+	for _, b := range in {
+		switch c.state {
+		case parseData:
+			if b == telnetIAC {
+				c.state = parseIAC
+			} else {
+				out = append(out, b)
+			}
+		case parseIAC:
+			switch b {
+			case telnetIAC:
+				out = append(out, b)
+				c.state = parseData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				c.verb = b
+				c.state = parseVerb
+			case telnetSB:
+				c.sb = c.sb[:0]
+				c.state = parseSB
+			default:
+				// NOP, GA and friends carry no meaning for us
+				c.state = parseData
+			}
+		case parseVerb:
+			c.negotiate(c.verb, b)
+			c.state = parseData
+		case parseSB:
+			if b == telnetIAC {
+				c.state = parseSBIAC
+			} else {
+				c.sb = append(c.sb, b)
+			}
+		case parseSBIAC:
+			switch b {
+			case telnetIAC:
+				c.sb = append(c.sb, b)
+				c.state = parseSB
+			case telnetSE:
+				c.subnegotiation(c.sb)
+				c.state = parseData
+			default:
+				// Malformed; abandon the subnegotiation
+				c.state = parseData
+			}
+		}
+	}
+	return out
+}
+
+func supportedOption(opt byte) bool {
+	return opt == optBinary || opt == optSGA || opt == optComPort
+}
+
+// request asks the client to enable an option, recording it as enabled so
+// that the acknowledgement doesn't trigger another round.
+func (c *rfc2217Conn) request(verb, opt byte) {
+	if verb == telnetWILL {
+		c.local[opt] = true
+	} else {
+		c.remote[opt] = true
+	}
+	_ = c.send([]byte{telnetIAC, verb, opt})
+}
+
+func (c *rfc2217Conn) negotiate(verb, opt byte) {
+	switch verb {
+	case telnetWILL:
+		if !supportedOption(opt) {
+			_ = c.send([]byte{telnetIAC, telnetDONT, opt})
+		} else if !c.remote[opt] {
+			c.remote[opt] = true
+			_ = c.send([]byte{telnetIAC, telnetDO, opt})
+		}
+	case telnetWONT:
+		if c.remote[opt] {
+			c.remote[opt] = false
+			_ = c.send([]byte{telnetIAC, telnetDONT, opt})
+		}
+	case telnetDO:
+		if !supportedOption(opt) {
+			_ = c.send([]byte{telnetIAC, telnetWONT, opt})
+		} else if !c.local[opt] {
+			c.local[opt] = true
+			_ = c.send([]byte{telnetIAC, telnetWILL, opt})
+		}
+	case telnetDONT:
+		if c.local[opt] {
+			c.local[opt] = false
+			_ = c.send([]byte{telnetIAC, telnetWONT, opt})
+		}
+	}
+}
+
+// subnegotiation handles a com port control command. Commands that change
+// the port are only honoured for clients allowed to write; everyone else
+// gets the current settings back.
+func (c *rfc2217Conn) subnegotiation(sb []byte) {
+	if len(sb) < 2 || sb[0] != optComPort {
+		return
+	}
+	cmd, data := sb[1], sb[2:]
+	p := c.l.port
+	allowed := func() bool { return c.l.canWrite(c.Conn) }
+
+	switch cmd {
+	case cpcSignature:
+		c.reply(cmd, []byte("sertcp "+p.dev))
+
+	case cpcSetBaudRate:
+		if len(data) == 4 {
+			if baud := int(binary.BigEndian.Uint32(data)); baud != 0 && allowed() {
+				c.setMode(func(m *serial.Mode) { m.BaudRate = baud })
+			}
+		}
+		c.reply(cmd, binary.BigEndian.AppendUint32(nil, uint32(p.Mode().BaudRate)))
+
+	case cpcSetDataSize:
+		if len(data) == 1 && data[0] >= 5 && data[0] <= 8 && allowed() {
+			c.setMode(func(m *serial.Mode) { m.DataBits = int(data[0]) })
+		}
+		c.reply(cmd, []byte{byte(p.Mode().DataBits)})
+
+	case cpcSetParity:
+		if len(data) == 1 && int(data[0]) < len(rfc2217Parities) && data[0] != 0 && allowed() {
+			c.setMode(func(m *serial.Mode) { m.Parity = rfc2217Parities[data[0]] })
+		}
+		c.reply(cmd, []byte{byte(wireValue(rfc2217Parities, p.Mode().Parity))})
+
+	case cpcSetStopSize:
+		if len(data) == 1 && int(data[0]) < len(rfc2217StopBits) && data[0] != 0 && allowed() {
+			c.setMode(func(m *serial.Mode) { m.StopBits = rfc2217StopBits[data[0]] })
+		}
+		c.reply(cmd, []byte{byte(wireValue(rfc2217StopBits, p.Mode().StopBits))})
+
+	case cpcSetControl:
+		if len(data) == 1 {
+			c.reply(cmd, []byte{c.control(data[0], allowed)})
+		}
+
+	case cpcNotifyModemState:
+		// Clients (e.g. pySerial) send this to poll the modem state.
+		if bits, err := modemState(p); err == nil {
+			c.reply(cpcNotifyModemState, []byte{bits})
+		}
+
+	case cpcFlowSuspend, cpcFlowResume:
+		// We don't buffer per client, so there is nothing to suspend.
+
+	case cpcSetLineStateMask:
+		if len(data) == 1 {
+			c.reply(cmd, data)
+		}
+
+	case cpcSetModemStateMask:
+		if len(data) == 1 {
+			c.mmut.Lock()
+			c.modemMask = data[0]
+			c.mmut.Unlock()
+			c.reply(cmd, data)
+		}
+
+	case cpcPurgeData:
+		if len(data) == 1 && allowed() {
+			_ = p.Purge(data[0]&1 != 0, data[0]&2 != 0)
+		}
+		c.reply(cmd, data)
+	}
+}
+
+// control handles SET-CONTROL and returns the value to reply with.
+func (c *rfc2217Conn) control(val byte, allowed func() bool) byte {
+	p := c.l.port
+	rts, dtr := p.Lines()
+	switch val {
+	case ctlDTROn, ctlDTROff:
+		if allowed() {
+			if err := p.SetDTR(val == ctlDTROn); err != nil {
+				log.Printf("set DTR on %s: %v", p.dev, err)
+			}
+			_, dtr = p.Lines()
+		}
+		fallthrough
+	case ctlDTRRequest:
+		if dtr {
+			return ctlDTROn
+		}
+		return ctlDTROff
+	case ctlRTSOn, ctlRTSOff:
+		if allowed() {
+			if err := p.SetRTS(val == ctlRTSOn); err != nil {
+				log.Printf("set RTS on %s: %v", p.dev, err)
+			}
+			rts, _ = p.Lines()
+		}
+		fallthrough
+	case ctlRTSRequest:
+		if rts {
+			return ctlRTSOn
+		}
+		return ctlRTSOff
+	case ctlBreakOn:
+		if allowed() {
+			go func() { _ = p.Break(250 * time.Millisecond) }()
+		}
+		return ctlBreakOff
+	case ctlBreakRequest, ctlBreakOff:
+		return ctlBreakOff
+	default:
+		// Flow control isn't supported by the serial package; whatever
+		// was asked for, we remain without.
+		return ctlFlowNone
+	}
+}
+
+func (c *rfc2217Conn) setMode(fn func(*serial.Mode)) {
+	mode, err := c.l.port.SetMode(fn)
+	if err != nil {
+		log.Printf("set mode on %s: %v", c.l.port.dev, err)
+		return
+	}
+	log.Printf("%s: %v set %d baud, %d data bits, parity %d, stop bits %d", c.l.port.dev, c.RemoteAddr(), mode.BaudRate, mode.DataBits, mode.Parity, mode.StopBits)
+}
+
+func (c *rfc2217Conn) reply(cmd byte, data []byte) {
+	buf := []byte{telnetIAC, telnetSB, optComPort, cmd + cpcServerOffset}
+	for _, b := range data {
+		buf = append(buf, b)
+		if b == telnetIAC {
+			buf = append(buf, telnetIAC)
+		}
+	}
+	buf = append(buf, telnetIAC, telnetSE)
+	_ = c.send(buf)
+}
+
+// pollModemState sends NOTIFY-MODEMSTATE to the client whenever the modem
+// input lines change.
+func (c *rfc2217Conn) pollModemState() {
+	t := time.NewTicker(modemPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		bits, err := modemState(c.l.port)
+		if err != nil {
+			continue
+		}
+		c.mmut.Lock()
+		changed := (bits ^ c.lastModem) & 0xf0
+		c.lastModem = bits
+		mask := c.modemMask
+		c.mmut.Unlock()
+		if changed == 0 {
+			continue
+		}
+		// The low nibble flags which lines changed since the last report.
+		bits |= changed >> 4
+		if bits&mask != 0 {
+			c.reply(cpcNotifyModemState, []byte{bits & mask})
+		}
+	}
+}
+
+func modemState(p *port) (byte, error) {
+	st, err := p.ModemStatus()
+	if err != nil {
+		return 0, err
+	}
+	var bits byte
+	if st.DCD {
+		bits |= 0x80
+	}
+	if st.RI {
+		bits |= 0x40
+	}
+	if st.DSR {
+		bits |= 0x20
+	}
+	if st.CTS {
+		bits |= 0x10
+	}
+	return bits, nil
+}
+
+// wireValue returns the RFC 2217 encoding of v given a table of settings
+// indexed by their wire values, or zero if there is none.
+func wireValue[T comparable](s []T, v T) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == v {
+			return i
+		}
+	}
+	return 0
+}
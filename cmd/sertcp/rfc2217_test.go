@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"calmh.dev/homeprom/internal/fanout"
+	"go.bug.st/serial"
+)
+
+type fakeSerial struct {
+	mut  sync.Mutex
+	mode serial.Mode
+	rts  bool
+	dtr  bool
+	in   chan []byte
+	out  bytes.Buffer
+}
+
+func (f *fakeSerial) SetMode(mode *serial.Mode) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.mode = *mode
+	return nil
+}
+
+func (f *fakeSerial) Read(p []byte) (int, error) {
+	bs, ok := <-f.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, bs), nil
+}
+
+func (f *fakeSerial) Write(p []byte) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.out.Write(p)
+}
+
+func (f *fakeSerial) SetDTR(dtr bool) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.dtr = dtr
+	return nil
+}
+
+func (f *fakeSerial) SetRTS(rts bool) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.rts = rts
+	return nil
+}
+
+func (f *fakeSerial) Drain() error                       { return nil }
+func (f *fakeSerial) ResetInputBuffer() error            { return nil }
+func (f *fakeSerial) ResetOutputBuffer() error           { return nil }
+func (f *fakeSerial) SetReadTimeout(time.Duration) error { return nil }
+func (f *fakeSerial) Close() error                       { return nil }
+func (f *fakeSerial) Break(time.Duration) error          { return nil }
+func (f *fakeSerial) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{CTS: true}, nil
+}
+
+func TestRFC2217(t *testing.T) {
+	fake := &fakeSerial{in: make(chan []byte)}
+	l := &listener{
+		cfg: listenerConfig{Protocol: protocolRFC2217, Write: writeAll},
+		port: &port{
+			dev:   "test",
+			fd:    fake,
+			lines: fanout.New[string](),
+			mode:  serial.Mode{BaudRate: 9600, DataBits: 8},
+		},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			buf := make([]byte, 256)
+			n, err := client.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- buf[:n]
+		}
+	}()
+
+	c := newRFC2217Conn(server, l)
+	defer c.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{
+			telnetIAC, telnetWILL, optComPort,
+			telnetIAC, telnetSB, optComPort, cpcSetBaudRate, 0x00, 0x00, 0x4b, 0x00, telnetIAC, telnetSE,
+			telnetIAC, telnetSB, optComPort, cpcSetControl, ctlDTROff, telnetIAC, telnetSE,
+			'h', 'i', telnetIAC, telnetIAC,
+		})
+	}()
+
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf[:n]; !bytes.Equal(got, []byte{'h', 'i', 0xff}) {
+		t.Errorf("unexpected data %x", got)
+	}
+
+	if l.port.Mode().BaudRate != 19200 || fake.mode.BaudRate != 19200 {
+		t.Error("baud rate not set")
+	}
+	if _, dtr := l.port.Lines(); dtr || fake.dtr {
+		t.Error("DTR not cleared")
+	}
+
+	if _, err := c.Write([]byte{'o', 0xff, 'k'}); err != nil {
+		t.Fatal(err)
+	}
+
+	var all []byte
+	timeout := time.After(time.Second)
+	for !bytes.Contains(all, []byte{'o', 0xff, 0xff, 'k'}) {
+		select {
+		case bs := <-received:
+			all = append(all, bs...)
+		case <-timeout:
+			t.Fatalf("missing escaped data in %x", all)
+		}
+	}
+
+	baudReply := []byte{telnetIAC, telnetSB, optComPort, cpcSetBaudRate + cpcServerOffset, 0x00, 0x00, 0x4b, 0x00, telnetIAC, telnetSE}
+	if !bytes.Contains(all, baudReply) {
+		t.Errorf("missing baud rate reply in %x", all)
+	}
+	dtrReply := []byte{telnetIAC, telnetSB, optComPort, cpcSetControl + cpcServerOffset, ctlDTROff, telnetIAC, telnetSE}
+	if !bytes.Contains(all, dtrReply) {
+		t.Errorf("missing DTR reply in %x", all)
+	}
+	if bytes.Contains(all, []byte{telnetIAC, telnetDO, optComPort, telnetIAC, telnetDO, optComPort}) {
+		t.Error("acknowledged option negotiated twice")
+	}
+}
+
+func TestRFC2217SettingsDontTakeWriteLock(t *testing.T) {
+	l := &listener{cfg: listenerConfig{Protocol: protocolRFC2217, Write: writeExclusive}, port: &port{dev: "test"}}
+	settings, _ := net.Pipe()
+	writer, _ := net.Pipe()
+	defer settings.Close()
+	defer writer.Close()
+
+	if !l.canWrite(settings) {
+		t.Fatal("settings refused with the write lock free")
+	}
+	if !l.mayWrite(writer) {
+		t.Fatal("write lock taken by changing settings")
+	}
+	if l.canWrite(settings) {
+		t.Error("settings allowed while another client has the write lock")
+	}
+}
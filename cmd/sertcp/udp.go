@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"calmh.dev/homeprom/internal/fanout"
+	"golang.org/x/net/ipv4"
+)
+
+// maxDatagramSize is the largest UDP payload we send; larger frames are
+// dropped rather than fragmented into something a receiver can't parse.
+const maxDatagramSize = 65507
+
+// udpOutput sends everything published by a port as datagrams to a
+// unicast or multicast destination, one datagram per chunk or frame.
+type udpOutput struct {
+	cfg    udpConfig
+	port   *port
+	conn   *net.UDPConn
+	bucket *tokenBucket
+}
+
+func newUDPOutput(uc udpConfig, p *port) *udpOutput {
+	dst, err := net.ResolveUDPAddr("udp", uc.Address)
+	if err != nil {
+		log.Fatalf("udp %s: %v", uc.Address, err)
+	}
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		log.Fatalf("udp %s: %v", uc.Address, err)
+	}
+	if dst.IP.IsMulticast() {
+		if err := setMulticastOptions(conn, uc); err != nil {
+			log.Fatalf("udp %s: %v", uc.Address, err)
+		}
+	}
+	return &udpOutput{
+		cfg:    uc,
+		port:   p,
+		conn:   conn,
+		bucket: newTokenBucket(uc.Rate, uc.Burst),
+	}
+}
+
+func setMulticastOptions(conn *net.UDPConn, uc udpConfig) error {
+	if uc.TTL == 0 && uc.Interface == "" {
+		return nil
+	}
+	pc := ipv4.NewPacketConn(conn)
+	if uc.TTL > 0 {
+		if err := pc.SetMulticastTTL(uc.TTL); err != nil {
+			return fmt.Errorf("set TTL: %w", err)
+		}
+	}
+	if uc.Interface != "" {
+		ifi, err := net.InterfaceByName(uc.Interface)
+		if err != nil {
+			return err
+		}
+		if err := pc.SetMulticastInterface(ifi); err != nil {
+			return fmt.Errorf("set interface: %w", err)
+		}
+	}
+	return nil
+}
+
+func (u *udpOutput) Serve() {
+	labels := []string{u.port.dev, u.cfg.Address}
+	sub := u.port.lines.Listen(fanout.Options{
+		OnDrop: udpDropped.WithLabelValues(append(labels, "buffer")...).Inc,
+	})
+	defer sub.Close()
+
+	for val := range sub.Channel() {
+		if len(val) > maxDatagramSize {
+			udpDropped.WithLabelValues(append(labels, "size")...).Inc()
+			continue
+		}
+		if !u.bucket.Allow() {
+			udpDropped.WithLabelValues(append(labels, "rate")...).Inc()
+			continue
+		}
+		if _, err := u.conn.Write([]byte(val)); err != nil {
+			// Typically ECONNREFUSED from a unicast receiver that isn't
+			// listening at the moment; keep going.
+			udpDropped.WithLabelValues(append(labels, "error")...).Inc()
+			continue
+		}
+		udpSentDatagrams.WithLabelValues(labels...).Inc()
+		udpSentBytes.WithLabelValues(labels...).Add(float64(len(val)))
+	}
+}
+
+// tokenBucket is a plain token bucket rate limiter, allowing rate events
+// per second on average with bursts of up to burst events.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Allow consumes a token and returns true if one is available.
+func (b *tokenBucket) Allow() bool {
+	return b.allowAt(time.Now())
+}
+
+func (b *tokenBucket) allowAt(now time.Time) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"calmh.dev/homeprom/internal/fanout"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+	for i := range 3 {
+		if !b.allowAt(now) {
+			t.Fatalf("burst event %d refused", i)
+		}
+	}
+	if b.allowAt(now) {
+		t.Fatal("allowed beyond burst")
+	}
+	if !b.allowAt(now.Add(500 * time.Millisecond)) {
+		t.Fatal("refused after refill")
+	}
+	if b.allowAt(now.Add(600 * time.Millisecond)) {
+		t.Fatal("allowed before refill")
+	}
+}
+
+func TestUDPOutput(t *testing.T) {
+	recv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+
+	p := &port{dev: "test", lines: fanout.New[string]()}
+	uc := udpConfig{Address: recv.LocalAddr().String()}
+	uc.setDefaults()
+	go newUDPOutput(uc, p).Serve()
+
+	// The output subscribes asynchronously; publish until something
+	// arrives.
+	_ = recv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for range 50 {
+			p.lines.Publish("$GPGGA,1*00\r\n")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	buf := make([]byte, 1500)
+	n, err := recv.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "$GPGGA,1*00\r\n" {
+		t.Errorf("received %q", got)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/alecthomas/kong v1.9.0
 	github.com/aliml92/ocpp v0.0.0-20230131044351-d3459aea5908
 	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/lmittmann/tint v1.0.7
 	github.com/mattn/go-isatty v0.0.20
 	github.com/prometheus/client_golang v1.21.1
@@ -14,6 +15,7 @@ require (
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/thejerf/suture/v4 v4.0.6
 	go.bug.st/serial v1.6.3
+	golang.org/x/net v0.33.0
 	golang.org/x/text v0.23.0
 )
 
@@ -24,14 +26,11 @@ require (
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/leodido/go-urn v1.4.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/prometheus/common v0.62.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
-	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/sync v0.12.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	google.golang.org/protobuf v1.36.1 // indirect
@@ -0,0 +1,275 @@
+// Package fanout broadcasts values to any number of subscribers, each
+// with its own buffer and policy for when that buffer is full.
+package fanout
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultBuffer = 16
+
+var (
+	ErrClosed         = errors.New("fanout closed")
+	ErrSlowSubscriber = errors.New("subscriber too slow")
+)
+
+// Policy decides what happens to a value published to a subscriber whose
+// buffer is full.
+type Policy int
+
+const (
+	DropNewest Policy = iota // discard the value being published
+	DropOldest               // discard the oldest buffered value to make room
+	Block                    // wait up to the timeout for room, then discard
+	Disconnect               // close the subscription
+)
+
+// Options for a subscription. The zero value is a buffer of
+// DefaultBuffer values, dropping new values when it's full.
+type Options struct {
+	Buffer  int
+	Policy  Policy
+	Timeout time.Duration // how long to block, with the Block policy
+	OnDrop  func()        // called for each discarded value
+	Replay  int           // history to start with, in the history's units
+}
+
+// Stats are the counters of a subscription.
+type Stats struct {
+	Delivered uint64 // values put in the buffer
+	Dropped   uint64 // values discarded by the policy
+	Buffered  int    // values currently waiting in the buffer
+}
+
+type Fanout[T any] struct {
+	mut     sync.Mutex
+	subs    []*Subscription[T]
+	history History[T]
+	closed  bool
+}
+
+func New[T any]() *Fanout[T] {
+	return &Fanout[T]{}
+}
+
+// NewWithHistory returns a fanout that remembers published values in
+// history, for new subscribers to catch up on.
+func NewWithHistory[T any](history History[T]) *Fanout[T] {
+	return &Fanout[T]{history: history}
+}
+
+// Publish delivers val to all subscribers, in the order of publishing.
+// With the Block policy it may wait for a slow subscriber, which holds up
+// delivery to the others as well.
+func (f *Fanout[T]) Publish(val T) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if f.history != nil {
+		f.history.Add(val)
+	}
+	kept := f.subs[:0]
+	for _, sub := range f.subs {
+		if sub.deliver(val) {
+			kept = append(kept, sub)
+		}
+	}
+	clear(f.subs[len(kept):])
+	f.subs = kept
+	return nil
+}
+
+// Listen returns a new subscription. If the fanout is closed, the
+// subscription's channel is closed from the start.
+func (f *Fanout[T]) Listen(opts Options) *Subscription[T] {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultBuffer
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var hist []T
+	if opts.Replay > 0 && f.history != nil {
+		hist = f.history.Replay(opts.Replay)
+	}
+	sub := &Subscription[T]{
+		fanout: f,
+		opts:   opts,
+		ch:     make(chan T, opts.Buffer+len(hist)),
+		done:   make(chan struct{}),
+	}
+	for _, val := range hist {
+		sub.ch <- val
+	}
+	if f.closed {
+		sub.close(ErrClosed)
+		return sub
+	}
+	f.subs = append(f.subs, sub)
+	return sub
+}
+
+// Close closes all subscriptions. Further values can't be published.
+func (f *Fanout[T]) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	f.closed = true
+	for _, sub := range f.subs {
+		sub.close(ErrClosed)
+	}
+	f.subs = nil
+	return nil
+}
+
+// Stats returns the statistics of each current subscription.
+func (f *Fanout[T]) Stats() []Stats {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	stats := make([]Stats, len(f.subs))
+	for i, sub := range f.subs {
+		stats[i] = sub.Stats()
+	}
+	return stats
+}
+
+func (f *Fanout[T]) release(rel *Subscription[T]) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for i, sub := range f.subs {
+		if sub == rel {
+			f.subs = append(f.subs[:i], f.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+type Subscription[T any] struct {
+	fanout *Fanout[T]
+	opts   Options
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	done     chan struct{} // closed when the subscriber closes
+	doneOnce sync.Once
+
+	mut    sync.Mutex // protects the fields below and sending on ch
+	ch     chan T
+	closed bool
+	err    error
+}
+
+// Channel returns the channel values are delivered on. It's closed when
+// the subscription ends for any reason; Err tells which.
+func (s *Subscription[T]) Channel() <-chan T {
+	return s.ch
+}
+
+// Close ends the subscription.
+func (s *Subscription[T]) Close() error {
+	s.doneOnce.Do(func() { close(s.done) })
+	s.fanout.release(s)
+	s.close(nil)
+	return nil
+}
+
+// Err returns why the subscription ended: ErrClosed when the fanout was
+// closed, ErrSlowSubscriber when disconnected by the Disconnect policy,
+// otherwise nil.
+func (s *Subscription[T]) Err() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.err
+}
+
+func (s *Subscription[T]) Stats() Stats {
+	return Stats{
+		Delivered: s.delivered.Load(),
+		Dropped:   s.dropped.Load(),
+		Buffered:  len(s.ch),
+	}
+}
+
+// deliver puts val in the buffer according to the policy. It returns
+// false if the subscription is no longer live.
+func (s *Subscription[T]) deliver(val T) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.ch <- val:
+		s.delivered.Add(1)
+		return true
+	default:
+	}
+
+	switch s.opts.Policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+			s.drop()
+		default:
+			// The subscriber made room in the meantime.
+		}
+		select {
+		case s.ch <- val:
+			s.delivered.Add(1)
+		default:
+			s.drop()
+		}
+
+	case Block:
+		timer := time.NewTimer(s.opts.Timeout)
+		defer timer.Stop()
+		select {
+		case s.ch <- val:
+			s.delivered.Add(1)
+		case <-timer.C:
+			s.drop()
+		case <-s.done:
+			s.drop()
+		}
+
+	case Disconnect:
+		s.drop()
+		s.closeLocked(ErrSlowSubscriber)
+		return false
+
+	default:
+		s.drop()
+	}
+	return true
+}
+
+func (s *Subscription[T]) drop() {
+	s.dropped.Add(1)
+	if s.opts.OnDrop != nil {
+		s.opts.OnDrop()
+	}
+}
+
+func (s *Subscription[T]) close(err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.closeLocked(err)
+}
+
+func (s *Subscription[T]) closeLocked(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.ch)
+}
@@ -0,0 +1,207 @@
+package fanout
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func drain[T any](ch <-chan T) []T {
+	var vals []T
+	for {
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return vals
+			}
+			vals = append(vals, v)
+		default:
+			return vals
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	cases := []struct {
+		policy  Policy
+		want    []int
+		dropped uint64
+		err     error
+	}{
+		{DropNewest, []int{0, 1}, 3, nil},
+		{DropOldest, []int{3, 4}, 3, nil},
+		{Block, []int{0, 1}, 3, nil},
+		{Disconnect, []int{0, 1}, 1, ErrSlowSubscriber},
+	}
+	for _, tc := range cases {
+		f := New[int]()
+		drops := 0
+		sub := f.Listen(Options{Buffer: 2, Policy: tc.policy, Timeout: time.Millisecond, OnDrop: func() { drops++ }})
+		for i := range 5 {
+			if err := f.Publish(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := drain(sub.Channel()); !slices.Equal(got, tc.want) {
+			t.Errorf("policy %d: got %v, expected %v", tc.policy, got, tc.want)
+		}
+		if st := sub.Stats(); st.Dropped != tc.dropped || drops != int(tc.dropped) {
+			t.Errorf("policy %d: dropped %d (%d callbacks), expected %d", tc.policy, st.Dropped, drops, tc.dropped)
+		}
+		if err := sub.Err(); err != tc.err {
+			t.Errorf("policy %d: error %v, expected %v", tc.policy, err, tc.err)
+		}
+	}
+}
+
+func TestBlockWaitsForReader(t *testing.T) {
+	f := New[int]()
+	sub := f.Listen(Options{Buffer: 1, Policy: Block, Timeout: time.Minute})
+	go func() {
+		for i := range 100 {
+			f.Publish(i)
+		}
+		f.Close()
+	}()
+	var got []int
+	for v := range sub.Channel() {
+		got = append(got, v)
+	}
+	if len(got) != 100 || got[99] != 99 {
+		t.Errorf("got %d values, expected all 100", len(got))
+	}
+	if sub.Err() != ErrClosed {
+		t.Errorf("unexpected error %v", sub.Err())
+	}
+}
+
+func TestCloseWhileBlocked(t *testing.T) {
+	f := New[int]()
+	sub := f.Listen(Options{Buffer: 1, Policy: Block, Timeout: time.Minute})
+	f.Publish(1)
+	published := make(chan struct{})
+	go func() {
+		f.Publish(2)
+		close(published)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sub.Close()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish still blocked after subscriber closed")
+	}
+	if len(f.Stats()) != 0 {
+		t.Error("closed subscription still listed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	f := New[string]()
+	subs := []*Subscription[string]{f.Listen(Options{}), f.Listen(Options{})}
+	f.Publish("a")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		if got := drain(sub.Channel()); !slices.Equal(got, []string{"a"}) {
+			t.Errorf("got %v before close", got)
+		}
+		if _, ok := <-sub.Channel(); ok {
+			t.Error("channel not closed")
+		}
+	}
+	if err := f.Publish("b"); err != ErrClosed {
+		t.Errorf("publish after close: %v", err)
+	}
+	if _, ok := <-f.Listen(Options{}).Channel(); ok {
+		t.Error("listen after close returned an open channel")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	f := New[int]()
+	const publishers, values = 4, 1000
+
+	var wg sync.WaitGroup
+	counts := make([]int, 8)
+	for i := range counts {
+		policy := Policy(i % 4)
+		sub := f.Listen(Options{Buffer: 4, Policy: policy, Timeout: time.Millisecond})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range sub.Channel() {
+				counts[i]++
+				if i == 0 {
+					// An early quitter.
+					sub.Close()
+				}
+			}
+		}()
+	}
+
+	var pwg sync.WaitGroup
+	for range publishers {
+		pwg.Add(1)
+		go func() {
+			defer pwg.Done()
+			for i := range values {
+				f.Publish(i)
+				_ = f.Stats()
+			}
+		}()
+	}
+	pwg.Wait()
+	f.Close()
+	wg.Wait()
+
+	for i, n := range counts {
+		if n == 0 || n > publishers*values {
+			t.Errorf("subscriber %d received %d values", i, n)
+		}
+	}
+}
+
+func TestReplayBytes(t *testing.T) {
+	f := NewWithHistory[string](NewByteHistory(8))
+	f.Publish("abc")
+	f.Publish("defgh")
+	f.Publish("ijk")
+
+	sub := f.Listen(Options{Replay: 5})
+	f.Publish("lmn")
+	if got := <-sub.Channel(); got != "ghijk" {
+		t.Errorf("replayed %q, expected %q", got, "ghijk")
+	}
+	if got := <-sub.Channel(); got != "lmn" {
+		t.Errorf("got %q after replay, expected %q", got, "lmn")
+	}
+
+	if got := NewByteHistory(4).Replay(4); got != nil {
+		t.Errorf("empty history replayed %q", got)
+	}
+	h := NewByteHistory(4)
+	h.Add("0123456789")
+	if got := h.Replay(10); !slices.Equal(got, []string{"6789"}) {
+		t.Errorf("long value replayed as %q", got)
+	}
+}
+
+func TestReplayValues(t *testing.T) {
+	f := NewWithHistory[string](NewValueHistory[string](2))
+	for _, frame := range []string{"one", "two", "three"} {
+		f.Publish(frame)
+	}
+
+	if got := drain(f.Listen(Options{Replay: 1}).Channel()); !slices.Equal(got, []string{"three"}) {
+		t.Errorf("replayed %q, expected last frame", got)
+	}
+	if got := drain(f.Listen(Options{Replay: 5}).Channel()); len(got) != 2 {
+		t.Errorf("replayed %q, expected the 2 kept", got)
+	}
+	if got := drain(f.Listen(Options{}).Channel()); len(got) != 0 {
+		t.Errorf("replayed %q without asking", got)
+	}
+}
@@ -0,0 +1,62 @@
+package fanout
+
+// A History remembers recently published values.
+type History[T any] interface {
+	Add(val T)
+	// Replay returns up to n units of the most recent history, oldest
+	// first.
+	Replay(n int) []T
+}
+
+// ValueHistory remembers the last few values, counting each as one unit.
+// It suits framed streams, where each value is a complete frame.
+type ValueHistory[T any] struct {
+	vals []T
+	max  int
+}
+
+func NewValueHistory[T any](max int) *ValueHistory[T] {
+	return &ValueHistory[T]{max: max}
+}
+
+func (h *ValueHistory[T]) Add(val T) {
+	if len(h.vals) == h.max {
+		h.vals = append(h.vals[:0], h.vals[1:]...)
+	}
+	h.vals = append(h.vals, val)
+}
+
+func (h *ValueHistory[T]) Replay(n int) []T {
+	n = min(n, len(h.vals))
+	return append([]T(nil), h.vals[len(h.vals)-n:]...)
+}
+
+// ByteHistory remembers the last bytes of a raw stream, regardless of how
+// they were chunked when published.
+type ByteHistory struct {
+	buf []byte
+	max int
+}
+
+func NewByteHistory(max int) *ByteHistory {
+	return &ByteHistory{buf: make([]byte, 0, max), max: max}
+}
+
+func (h *ByteHistory) Add(val string) {
+	if len(val) >= h.max {
+		h.buf = append(h.buf[:0], val[len(val)-h.max:]...)
+		return
+	}
+	if over := len(h.buf) + len(val) - h.max; over > 0 {
+		h.buf = h.buf[:copy(h.buf, h.buf[over:])]
+	}
+	h.buf = append(h.buf, val...)
+}
+
+func (h *ByteHistory) Replay(n int) []string {
+	n = min(n, len(h.buf))
+	if n == 0 {
+		return nil
+	}
+	return []string{string(h.buf[len(h.buf)-n:])}
+}
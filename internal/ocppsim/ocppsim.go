@@ -0,0 +1,344 @@
+// Package ocppsim is a simulated OCPP-J charge point, for running scripted
+// scenarios or replaying frame logs against a central system in tests.
+package ocppsim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTimeout is how long calls wait for the response, unless the
+// charge point's Timeout says otherwise.
+const DefaultTimeout = 10 * time.Second
+
+const (
+	messageCall       = 2
+	messageCallResult = 3
+	messageCallError  = 4
+)
+
+var (
+	ErrClosed  = errors.New("connection closed")
+	ErrTimeout = errors.New("timeout waiting for response")
+)
+
+// CallError is the central system's error response to a call.
+type CallError struct {
+	Code        string
+	Description string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// A Handler answers a call from the central system with the response
+// payload.
+type Handler func(action string, payload json.RawMessage) any
+
+// DefaultHandler accepts whatever it's asked to do, without doing it, and
+// has an empty configuration and no local list.
+func DefaultHandler(action string, _ json.RawMessage) any {
+	switch action {
+	case "GetConfiguration":
+		return map[string]any{"configurationKey": []any{}}
+	case "GetLocalListVersion":
+		return map[string]any{"listVersion": -1}
+	default:
+		return map[string]any{"status": "Accepted"}
+	}
+}
+
+// ChargePoint is a charger connected to a central system. Calls from the
+// central system are answered by DefaultHandler, unless another is set.
+type ChargePoint struct {
+	Timeout time.Duration
+
+	conn   *websocket.Conn
+	wmut   sync.Mutex
+	closed chan struct{}
+
+	mut     sync.Mutex
+	handler Handler
+	lastID  int
+	pending map[string]chan response
+}
+
+type response struct {
+	payload json.RawMessage
+	err     error
+}
+
+// Dial connects to the central system at url, which is without the charge
+// point ID, with basic auth unless password is empty.
+func Dial(url, id, proto, password string) (*ChargePoint, error) {
+	hdr := http.Header{}
+	if password != "" {
+		hdr.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(id+":"+password)))
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{proto}, HandshakeTimeout: DefaultTimeout}
+	conn, _, err := dialer.Dial(url+"/"+id, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != proto {
+		conn.Close()
+		return nil, fmt.Errorf("central system chose protocol %q", conn.Subprotocol())
+	}
+	return New(conn), nil
+}
+
+// New returns a charge point on an established connection.
+func New(conn *websocket.Conn) *ChargePoint {
+	cp := &ChargePoint{
+		handler: DefaultHandler,
+		Timeout: DefaultTimeout,
+		conn:    conn,
+		closed:  make(chan struct{}),
+		pending: make(map[string]chan response),
+	}
+	go cp.serve()
+	return cp
+}
+
+// SetHandler sets the handler for the calls from the central system.
+func (cp *ChargePoint) SetHandler(h Handler) {
+	cp.mut.Lock()
+	cp.handler = h
+	cp.mut.Unlock()
+}
+
+// Close disconnects from the central system.
+func (cp *ChargePoint) Close() error {
+	return cp.conn.Close()
+}
+
+// Call makes a call to the central system and unmarshals the response
+// into res, unless it's nil.
+func (cp *ChargePoint) Call(action string, req, res any) error {
+	payload, err := cp.call(action, req)
+	if err != nil || res == nil {
+		return err
+	}
+	return json.Unmarshal(payload, res)
+}
+
+func (cp *ChargePoint) call(action string, req any) (json.RawMessage, error) {
+	ch := make(chan response, 1)
+	cp.mut.Lock()
+	cp.lastID++
+	id := strconv.Itoa(cp.lastID)
+	cp.pending[id] = ch
+	cp.mut.Unlock()
+	defer func() {
+		cp.mut.Lock()
+		delete(cp.pending, id)
+		cp.mut.Unlock()
+	}()
+
+	if err := cp.write(messageCall, id, action, req); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.payload, r.err
+	case <-cp.closed:
+		return nil, ErrClosed
+	case <-time.After(cp.Timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (cp *ChargePoint) serve() {
+	defer close(cp.closed)
+	for {
+		var frame []json.RawMessage
+		if err := cp.conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		if len(frame) < 3 {
+			continue
+		}
+		var typ int
+		var uid string
+		_ = json.Unmarshal(frame[0], &typ)
+		_ = json.Unmarshal(frame[1], &uid)
+
+		switch typ {
+		case messageCall:
+			var action string
+			if len(frame) != 4 || json.Unmarshal(frame[2], &action) != nil {
+				continue
+			}
+			cp.mut.Lock()
+			h := cp.handler
+			cp.mut.Unlock()
+			if err := cp.write(messageCallResult, uid, h(action, frame[3])); err != nil {
+				return
+			}
+		case messageCallResult:
+			cp.deliver(uid, response{payload: frame[2]})
+		case messageCallError:
+			var callErr CallError
+			_ = json.Unmarshal(frame[2], &callErr.Code)
+			if len(frame) > 3 {
+				_ = json.Unmarshal(frame[3], &callErr.Description)
+			}
+			cp.deliver(uid, response{err: &callErr})
+		}
+	}
+}
+
+func (cp *ChargePoint) deliver(uid string, r response) {
+	cp.mut.Lock()
+	defer cp.mut.Unlock()
+	if ch, ok := cp.pending[uid]; ok {
+		ch <- r
+	}
+}
+
+func (cp *ChargePoint) write(fields ...any) error {
+	cp.wmut.Lock()
+	defer cp.wmut.Unlock()
+	return cp.conn.WriteJSON(fields)
+}
+
+// LoggedFrame is a line of the central system's frame log.
+type LoggedFrame struct {
+	Time        time.Time       `json:"time"`
+	ChargePoint string          `json:"chargepoint"`
+	Direction   string          `json:"direction"` // "in" from the charger, "out" to it
+	Frame       json.RawMessage `json:"frame"`
+}
+
+// Replay makes the calls the charger made in a frame log, in order and
+// each after the response to the one before, without waiting out the
+// time between them. Only the calls of chargePoint are replayed, or of all
+// chargers if it's empty. The payloads are as they were, but with the
+// transaction IDs from the logged StartTransaction responses mapped to the
+// ones we get, and with the timestamps moved by how long ago the first call
+// was logged. Those that would then be in the future, as the calls come
+// quicker than they were logged, are brought back to now; they stay in
+// order but the time between them is lost. Error responses don't stop the
+// replay, as the log may well have them too.
+func (cp *ChargePoint) Replay(r io.Reader, chargePoint string) error {
+	var offset time.Duration // from the logged times to now
+	first := true
+	started := make(map[string]int) // our transaction IDs by logged StartTransaction call
+	transactions := make(map[int]int)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		var lf LoggedFrame
+		if err := json.Unmarshal(sc.Bytes(), &lf); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if chargePoint != "" && lf.ChargePoint != chargePoint {
+			continue
+		}
+		// Anything but a well formed message, including what wasn't JSON.
+		var frame []json.RawMessage
+		var typ int
+		var uid string
+		if json.Unmarshal(lf.Frame, &frame) != nil || len(frame) < 3 || json.Unmarshal(frame[0], &typ) != nil || json.Unmarshal(frame[1], &uid) != nil {
+			continue
+		}
+		key := lf.ChargePoint + "/" + uid
+
+		if lf.Direction == "out" && typ == messageCallResult {
+			if id, ok := started[key]; ok {
+				delete(started, key)
+				var res struct {
+					TransactionID int `json:"transactionId"`
+				}
+				if json.Unmarshal(frame[2], &res) == nil && res.TransactionID != 0 {
+					transactions[res.TransactionID] = id
+				}
+			}
+			continue
+		}
+		var action string
+		if lf.Direction != "in" || typ != messageCall || len(frame) != 4 || json.Unmarshal(frame[2], &action) != nil {
+			continue
+		}
+
+		if first {
+			offset = time.Since(lf.Time)
+			first = false
+		}
+		res, err := cp.call(action, rebase(frame[3], offset, transactions))
+		var callErr *CallError
+		if err != nil && !errors.As(err, &callErr) {
+			return fmt.Errorf("line %d: %s: %w", line, action, err)
+		}
+		if action == "StartTransaction" && err == nil {
+			var conf struct {
+				TransactionID int `json:"transactionId"`
+			}
+			if json.Unmarshal(res, &conf) == nil {
+				started[key] = conf.TransactionID
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// rebase returns the payload with its timestamps moved by offset, but no
+// later than now, and its transaction IDs mapped, leaving alone what it
+// doesn't recognise.
+func rebase(payload json.RawMessage, offset time.Duration, transactions map[int]int) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return payload
+	}
+	bs, err := json.Marshal(rebaseValue(v, offset, transactions))
+	if err != nil {
+		return payload
+	}
+	return bs
+}
+
+func rebaseValue(v any, offset time.Duration, transactions map[int]int) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			switch e := e.(type) {
+			case json.Number:
+				if id, err := strconv.Atoi(e.String()); err == nil && k == "transactionId" {
+					if ours, ok := transactions[id]; ok {
+						v[k] = ours
+					}
+				}
+			case string:
+				if t, err := time.Parse(time.RFC3339Nano, e); err == nil && k == "timestamp" {
+					t = t.Add(offset)
+					if now := time.Now(); t.After(now) {
+						t = now
+					}
+					v[k] = t.UTC().Format(time.RFC3339Nano)
+				}
+			default:
+				v[k] = rebaseValue(e, offset, transactions)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = rebaseValue(e, offset, transactions)
+		}
+	}
+	return v
+}
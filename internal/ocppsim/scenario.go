@@ -0,0 +1,83 @@
+package ocppsim
+
+import (
+	"strconv"
+	"time"
+)
+
+// The steps of the usual OCPP 1.6 scenarios. The timestamps are the
+// current time, as from a charger with a good clock.
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// Boot sends a BootNotification and returns the registration status.
+func (cp *ChargePoint) Boot(vendor, model string) (string, error) {
+	var res struct {
+		Status string `json:"status"`
+	}
+	err := cp.Call("BootNotification", map[string]any{"chargePointVendor": vendor, "chargePointModel": model}, &res)
+	return res.Status, err
+}
+
+// Heartbeat sends a Heartbeat.
+func (cp *ChargePoint) Heartbeat() error {
+	return cp.Call("Heartbeat", map[string]any{}, nil)
+}
+
+// Status sends a StatusNotification without error for the connector, or
+// the whole charger for connector zero.
+func (cp *ChargePoint) Status(connector int, status string) error {
+	return cp.Call("StatusNotification", map[string]any{
+		"connectorId": connector,
+		"errorCode":   "NoError",
+		"status":      status,
+		"timestamp":   now(),
+	}, nil)
+}
+
+// StartTransaction starts a transaction and returns its ID and the
+// authorization status of the idTag.
+func (cp *ChargePoint) StartTransaction(connector int, idTag string, meterStartWh int) (int, string, error) {
+	var res struct {
+		TransactionID int `json:"transactionId"`
+		IDTagInfo     struct {
+			Status string `json:"status"`
+		} `json:"idTagInfo"`
+	}
+	err := cp.Call("StartTransaction", map[string]any{
+		"connectorId": connector,
+		"idTag":       idTag,
+		"meterStart":  meterStartWh,
+		"timestamp":   now(),
+	}, &res)
+	return res.TransactionID, res.IDTagInfo.Status, err
+}
+
+// MeterValues sends readings of the energy register and, when positive,
+// the power.
+func (cp *ChargePoint) MeterValues(connector, transaction, registerWh int, powerW float64) error {
+	sampled := []map[string]any{{"value": strconv.Itoa(registerWh), "measurand": "Energy.Active.Import.Register", "unit": "Wh"}}
+	if powerW > 0 {
+		sampled = append(sampled, map[string]any{"value": strconv.FormatFloat(powerW, 'f', -1, 64), "measurand": "Power.Active.Import", "unit": "W"})
+	}
+	req := map[string]any{
+		"connectorId": connector,
+		"meterValue":  []map[string]any{{"timestamp": now(), "sampledValue": sampled}},
+	}
+	if transaction != 0 {
+		req["transactionId"] = transaction
+	}
+	return cp.Call("MeterValues", req, nil)
+}
+
+// StopTransaction stops the transaction at the final register reading.
+func (cp *ChargePoint) StopTransaction(transaction, meterStopWh int, reason string) error {
+	return cp.Call("StopTransaction", map[string]any{
+		"transactionId": transaction,
+		"meterStop":     meterStopWh,
+		"timestamp":     now(),
+		"reason":        reason,
+	}, nil)
+}
@@ -0,0 +1,133 @@
+// Package testcert makes a throwaway CA with server and client
+// certificates, for testing TLS listeners.
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Files are the PEM files of a CA and a server certificate for localhost
+// signed by it.
+type Files struct {
+	CA, Cert, Key string
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+// New writes a CA and a server certificate to a temporary directory.
+func New(t testing.TB) *Files {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, ca := create(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	f := &Files{
+		CA:    filepath.Join(dir, "ca.pem"),
+		Cert:  filepath.Join(dir, "cert.pem"),
+		Key:   filepath.Join(dir, "key.pem"),
+		ca:    ca,
+		caKey: caKey,
+	}
+	write(t, f.CA, "CERTIFICATE", ca.Raw)
+
+	key, cert := create(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	write(t, f.Cert, "CERTIFICATE", cert.Raw)
+	keyBs, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, f.Key, "EC PRIVATE KEY", keyBs)
+	return f
+}
+
+// Pool returns a pool with the CA, to verify the server with.
+func (f *Files) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(f.ca)
+	return pool
+}
+
+// Client returns a client certificate with the common name, signed by the
+// CA.
+func (f *Files) Client(t testing.TB, commonName string) tls.Certificate {
+	t.Helper()
+	return client(t, commonName, f.ca, f.caKey)
+}
+
+// Untrusted returns a client certificate with the common name, signed by
+// a CA of its own.
+func Untrusted(t testing.TB, commonName string) tls.Certificate {
+	t.Helper()
+	caKey, ca := create(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "other CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	return client(t, commonName, ca, caKey)
+}
+
+func client(t testing.TB, commonName string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	key, cert := create(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// create makes a certificate from the template, self-signed when parent
+// is nil.
+func create(t testing.TB, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func write(t testing.TB, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}